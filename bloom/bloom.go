@@ -99,8 +99,10 @@ func buildBloom() {
 	scanner := bufio.NewScanner(snr)
 	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
 
-	// Workspace for sequence diversity checker
-	wk := make([]int, 25)
+	// The same complexity filters are used in window_reads
+	cfilter := utils.NewComplexityFilter(config)
+
+	strands := config.Strands()
 
 	var j int
 	for ; scanner.Scan(); j++ {
@@ -112,28 +114,39 @@ func buildBloom() {
 		line := scanner.Bytes()
 		seq := bytes.Fields(line)[0]
 
-		for k := 0; k < len(config.Windows); k++ {
-			q1 := config.Windows[k]
-			q2 := q1 + config.WindowWidth
-			if q2 > len(seq) {
-				continue
-			}
-			seqw := seq[q1:q2]
-			if utils.CountDinuc(seqw, wk) < config.MinDinuc {
-				continue
+		for _, strand := range strands {
+
+			// Reverse strand windows are taken from the
+			// reverse complement of the read, as in
+			// window_reads.
+			sseq := seq
+			if strand == '-' {
+				sseq = utils.RevComp(seq)
 			}
 
-			for _, ha := range hashes {
-				ha.Reset()
-				_, err = ha.Write(seqw)
-				if err != nil {
-					panic(err)
+			for k := 0; k < len(config.Windows); k++ {
+				q1 := config.Windows[k]
+				q2 := q1 + config.WindowWidth
+				if q2 > len(sseq) {
+					continue
 				}
-				x := uint64(ha.Sum32()) % config.BloomSize
-				err := smp[k].SetBit(x)
-				if err != nil {
-					logger.Print(err)
-					panic(err)
+				seqw := sseq[q1:q2]
+				if !cfilter.Check(seqw) {
+					continue
+				}
+
+				for _, ha := range hashes {
+					ha.Reset()
+					_, err = ha.Write(seqw)
+					if err != nil {
+						panic(err)
+					}
+					x := uint64(ha.Sum32()) % config.BloomSize
+					err := smp[k].SetBit(x)
+					if err != nil {
+						logger.Print(err)
+						panic(err)
+					}
 				}
 			}
 		}
@@ -146,6 +159,7 @@ func buildBloom() {
 		panic(err)
 	}
 
+	cfilter.LogDropped(logger)
 	logger.Printf("Done constructing Bloom filters")
 }
 
@@ -191,6 +205,13 @@ func checkwin(ix []int, iw []uint64, hashes []rollinghash.Hash32) []int {
 // process one target sequence, runs concurrently with main loop.
 func processseq(seq []byte, genenum int) {
 
+	// Sequences shorter than a window cannot match.  These include
+	// the empty rows left by targets removed from a bundle.
+	if len(seq) < config.WindowWidth {
+		<-limit
+		return
+	}
+
 	hashes := make([]rollinghash.Hash32, config.NumHash)
 	for j := range hashes {
 		hashes[j] = buzhash32.NewFromUint32Array(tables[j])
@@ -206,12 +227,22 @@ func processseq(seq []byte, genenum int) {
 	ix := make([]int, len(smp))
 	iw := make([]uint64, config.NumHash)
 
+	// The position of the last soft-masked (lower case) letter,
+	// windows containing soft-masked letters are not used as exact
+	// matches.
+	lastMasked := -1
+	for j, c := range seq[0:hlen] {
+		if utils.IsSoftMasked(c) {
+			lastMasked = j
+		}
+	}
+
 	// Check if the initial window is a match
 	ix = checkwin(ix, iw, hashes)
 	for _, i := range ix {
 
 		q1 := config.Windows[i]
-		if q1 != 0 {
+		if q1 != 0 || lastMasked != -1 {
 			continue
 		}
 		q2 := q1 + config.WindowWidth
@@ -236,6 +267,9 @@ func processseq(seq []byte, genenum int) {
 		for _, ha := range hashes {
 			ha.Roll(seq[j])
 		}
+		if utils.IsSoftMasked(seq[j]) {
+			lastMasked = j
+		}
 		ix = checkwin(ix, iw, hashes)
 
 		// Process a match
@@ -250,6 +284,9 @@ func processseq(seq []byte, genenum int) {
 			// Matching sequence is jx:jy
 			jx := j - hlen + 1
 			jy := j + 1
+			if lastMasked >= jx {
+				continue
+			}
 
 			// Left tail is jw:jx
 			jw := jx - q1
@@ -178,11 +178,13 @@ func (b *breader) Next() bool {
 	return true
 }
 
-// cdiff returns the number of unequal values in two byte sequences
+// cdiff returns the number of positions at which the read sequence y
+// does not match the target sequence x.  A read base matches an IUPAC
+// ambiguity code in the target that includes it.
 func cdiff(x, y []byte) int {
 	var c int
 	for i, v := range x {
-		if v != y[i] {
+		if !utils.BaseMatch(v, y[i]) {
 			c++
 		}
 	}
@@ -238,6 +240,7 @@ func searchpairs(source, match []*rec, limit chan bool) {
 			stag = srec.fields[0] // must equal mtag
 			slft := srec.fields[1]
 			srgt := srec.fields[2]
+			strand := srec.fields[3]
 
 			// Allowed number of mismatches
 			nmiss := int((1 - config.PMatch) * float64(len(stag)+len(slft)+len(srgt)))
@@ -265,14 +268,23 @@ func searchpairs(source, match []*rec, limit chan bool) {
 			// Found a match, pass to output
 			buf := getbuf()
 			bbuf := bytes.NewBuffer(buf)
-			bbuf.Write(slft)
-			bbuf.Write(stag)
-			bbuf.Write(srgt)
+			if strand[0] == '-' {
+				// The windows were taken from the reverse
+				// complement of the read, report the read
+				// as given.
+				rd := make([]byte, 0, len(slft)+len(stag)+len(srgt))
+				rd = append(append(append(rd, slft...), stag...), srgt...)
+				bbuf.Write(utils.RevComp(rd))
+			} else {
+				bbuf.Write(slft)
+				bbuf.Write(stag)
+				bbuf.Write(srgt)
+			}
 			bbuf.Write([]byte("\t"))
 			bbuf.Write(mlft)
 			bbuf.Write(mtag)
 			bbuf.Write(mrgt[0:mk])
-			x := fmt.Sprintf("\t%d\t%d\t%s\n", mposi-len(mlft), nx, mgene)
+			x := fmt.Sprintf("\t%d\t%d\t%s\t%s\n", mposi-len(mlft), nx, mgene, strand)
 			bbuf.Write([]byte(x))
 
 			qq := &qrect{mismatch: nx, gob: bbuf.Bytes()}
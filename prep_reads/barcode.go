@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A barcode identifies the sample from which a read was obtained.
+type barcode struct {
+	seq    []byte
+	sample string
+}
+
+// readBarcodes reads the barcode sheet, which has one barcode and
+// sample name per line, separated by whitespace.  Blank lines and
+// lines starting with # are skipped.
+func readBarcodes() {
+
+	fid, err := os.Open(config.BarcodeFileName)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(fid)
+	for lnum := 1; scanner.Scan(); lnum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			panic(fmt.Sprintf("%s: line %d does not contain a barcode and a sample name",
+				config.BarcodeFileName, lnum))
+		}
+
+		// Sample names appear in the comma separated
+		// sample:count lists of the results.
+		if strings.ContainsAny(f[1], ":,") || f[1] == "-" {
+			panic(fmt.Sprintf("%s: line %d: invalid sample name '%s'",
+				config.BarcodeFileName, lnum, f[1]))
+		}
+
+		bc := strings.ToUpper(f[0])
+		if seen[bc] {
+			panic(fmt.Sprintf("%s: line %d: duplicate barcode %s",
+				config.BarcodeFileName, lnum, bc))
+		}
+		seen[bc] = true
+
+		barcodes = append(barcodes, barcode{seq: []byte(bc), sample: f[1]})
+	}
+
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	if len(barcodes) == 0 {
+		panic(fmt.Sprintf("%s contains no barcodes", config.BarcodeFileName))
+	}
+}
+
+// assignSample returns the sample whose barcode best matches the 5'
+// end of a read, and the length of the barcode.  A blank sample is
+// returned if no barcode matches with at most BarcodeMismatches
+// mismatches, or if the best match is shared by barcodes of different
+// samples.
+func assignSample(seq string) (string, int) {
+
+	xseq := []byte(strings.ToUpper(seq))
+
+	best, sample, blen := config.BarcodeMismatches+1, "", 0
+	for _, bc := range barcodes {
+		if len(bc.seq) > len(xseq) {
+			continue
+		}
+
+		n := nmiss(xseq[0:len(bc.seq)], bc.seq, best)
+		switch {
+		case n < best:
+			best, sample, blen = n, bc.sample, len(bc.seq)
+		case n == best && bc.sample != sample:
+			// Ambiguous
+			sample, blen = "", 0
+		}
+	}
+
+	return sample, blen
+}
@@ -1,15 +1,33 @@
-// prep_reads converts a source file of sequencing reads from fastq
-// format to a simple format with one sequence per row, used
-// internally by Muscato
+// prep_reads converts a source file of sequencing reads from fastq,
+// fasta or tab-delimited format to a simple format with one sequence
+// per row, used internally by Muscato.  Each output row contains the
+// processed sequence, the read name, the UMI of the read and the
+// sample of the read (blank if UMIs or sample barcodes are not used),
+// and the position of the file containing the read in the list of
+// read files.
+//
+// Several read files may be given, and are processed in turn.  For
+// paired-end data, the two mates are read in parallel from two files,
+// and are tagged with /1 and /2 suffixes on their names.
+//
+// The original records (including qualities) are saved in
+// reads_raw.txt.sz in the workspace directory, so that the records of
+// unmatched reads can be reproduced exactly.
 
 package main
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"os"
 	"path"
+	"regexp"
+	"strings"
 
+	"github.com/golang/snappy"
 	"github.com/kshedden/seqmatch/utils"
 )
 
@@ -24,6 +42,50 @@ var (
 	tmpdir string
 
 	logger *log.Logger
+
+	// The original read records, written to reads_raw.txt.sz
+	rawout io.Writer
+
+	// The number of reads that were quality trimmed
+	ntrim int
+
+	// The number of bases that were masked due to low quality
+	nmask int
+
+	// The 3' adapters and 5' primers to trim, in upper case
+	adapters [][]byte
+	primers  [][]byte
+
+	// The number of reads trimmed using each adapter and primer
+	adapterCounts []int
+	primerCounts  []int
+
+	// Extracts the UMI from a read name, nil if UMIPattern is blank
+	umiRegexp *regexp.Regexp
+
+	// The number of reads with poly-T heads, poly-A tails and
+	// homopolymer tails trimmed
+	npolyT       int
+	npolyA       int
+	nhomopolymer int
+
+	// The number of reads with a non-blank UMI
+	numi int
+
+	// The number of reads that are too short to use
+	nskip int
+
+	// The number of reads (or pairs) read from all the read files
+	nread int
+
+	// The sample barcodes, if reads from several samples are
+	// pooled
+	barcodes []barcode
+
+	// The number of reads assigned to each sample, and the number
+	// of reads that could not be assigned to a sample
+	sampleCounts map[string]int
+	nunassigned  int
 )
 
 // subx replaces non A/T/G/C with X
@@ -40,53 +102,394 @@ func subx(seq []byte) {
 	}
 }
 
-func source() {
+// readName returns the identifier of a read, which is the first
+// whitespace-delimited token of its name line.
+func readName(name string) string {
+	if i := strings.IndexAny(name, " \t"); i != -1 {
+		name = name[0:i]
+	}
+	return name
+}
+
+// mateBase returns the identifier of a paired read with any mate
+// suffix (/1 or /2) removed, so that the two mates of a pair have
+// the same base name.
+func mateBase(name string) string {
+	name = readName(name)
+	if strings.HasSuffix(name, "/1") || strings.HasSuffix(name, "/2") {
+		name = name[0 : len(name)-2]
+	}
+	return name
+}
 
-	ris := utils.NewReadInSeq(config.ReadFileName, "")
+// writeRaw writes the original form of a read to the raw read file.
+// The fields are the processed sequence, the mate number, the
+// original sequence, the qualities, the separator line (blank unless
+// the read is from a fastq file) and the name line.
+func writeRaw(bbuf *bytes.Buffer, xseq []byte, ris *utils.ReadInSeq, mate int) {
 
-	var bbuf bytes.Buffer
+	bbuf.Reset()
+	bbuf.Write(xseq)
+	bbuf.WriteString(fmt.Sprintf("\t%d\t", mate))
+	bbuf.WriteString(ris.Seq)
+	bbuf.WriteString("\t")
+	bbuf.WriteString(ris.Qual)
+	bbuf.WriteString("\t")
+	bbuf.WriteString(ris.Sep)
+	bbuf.WriteString("\t")
+	bbuf.WriteString(ris.Name)
+	bbuf.WriteString("\n")
 
-	nskip := 0
+	_, err := rawout.Write(bbuf.Bytes())
+	if err != nil {
+		panic(err)
+	}
+}
 
-	var lnum int
-	for lnum = 0; ris.Next(); lnum++ {
+// emit writes one read to stdout, returning false if the read is too
+// short to be used.  The mate is 0 for single-end reads, otherwise 1
+// or 2.  The second mate is reverse complemented after truncation.
+// The first skip bases of the read are removed before any other
+// processing, and the tags are written after the read name.
+//
+// The original record is also written to the raw read file, keyed
+// by the processed sequence, so that unmatched reads can be written
+// out in full at the end of the run.
+func emit(bbuf *bytes.Buffer, ris *utils.ReadInSeq, name string, mate, skip int, tags readTags) bool {
 
-		bbuf.Reset()
+	bbuf.Reset()
 
-		if len(ris.Seq) < config.MinReadLength {
-			nskip++
-			continue
+	seq, qual := ris.Seq, ris.Qual
+	xseq := []byte(seq)
+
+	// Qualities are trimmed along with the sequence.
+	var xqual []byte
+	if len(qual) == len(seq) {
+		xqual = []byte(qual)
+	}
+
+	// Remove bases that do not come from the template, such as an
+	// inline UMI.
+	xseq = xseq[skip:]
+	if xqual != nil {
+		xqual = xqual[skip:]
+	}
+
+	// Primer and adapter trimming
+	if n, k := primerTrim(xseq); k != -1 {
+		primerCounts[k]++
+		xseq = xseq[n:]
+		if xqual != nil {
+			xqual = xqual[n:]
 		}
+	}
+	if n, k := adapterTrim(xseq); k != -1 {
+		adapterCounts[k]++
+		xseq = xseq[0:n]
+		if xqual != nil {
+			xqual = xqual[0:n]
+		}
+	}
+
+	// Poly-A, poly-T and homopolymer trimming, after removing
+	// the adapter that may follow a poly-A tail.
+	if head, tail := polyTrim(xseq); head+tail > 0 {
+		xseq = xseq[head : len(xseq)-tail]
+		if xqual != nil {
+			xqual = xqual[head : len(xqual)-tail]
+		}
+	}
+
+	// Quality trimming and masking, only possible if the read
+	// has quality scores.
+	if xqual != nil {
+		if config.TrimQuality > 0 {
+			n := qualTrim(xqual)
+			if n < len(xseq) {
+				ntrim++
+				xseq = xseq[0:n]
+				xqual = xqual[0:n]
+			}
+		}
+		if config.MaskQuality > 0 {
+			nmask += qualMask(xseq, xqual)
+		}
+	}
 
-		xseq := []byte(ris.Seq)
+	short := len(xseq) < config.MinReadLength
+	if !short {
 		subx(xseq)
 
 		if len(xseq) > config.MaxReadLength {
 			xseq = xseq[0:config.MaxReadLength]
 		}
 
-		_, err := bbuf.Write(append(xseq, '\t'))
-		if err != nil {
-			panic(err)
+		if mate == 2 {
+			xseq = utils.RevComp(xseq)
 		}
+	}
+
+	writeRaw(bbuf, xseq, ris, mate)
+	if short {
+		return false
+	}
+
+	bbuf.Reset()
+	_, err := bbuf.Write(append(xseq, '\t'))
+	if err != nil {
+		panic(err)
+	}
 
-		rn := ris.Name
-		if len(rn) > maxNameLen {
-			rn = rn[0:(maxNameLen-5)] + "..."
+	if len(name) > maxNameLen {
+		name = name[0:(maxNameLen-5)] + "..."
+	}
+	bbuf.Write([]byte(name))
+
+	bbuf.Write([]byte("\t"))
+	bbuf.Write([]byte(tags.umi))
+	bbuf.Write([]byte("\t"))
+	bbuf.Write([]byte(tags.sample))
+	bbuf.WriteString(fmt.Sprintf("\t%d", tags.file))
+
+	bbuf.Write([]byte("\n"))
+
+	_, err = os.Stdout.Write(bbuf.Bytes())
+	if err != nil {
+		panic(err)
+	}
+
+	return true
+}
+
+func source() {
+
+	// Setup the raw read file
+	fname := path.Join(tmpdir, "reads_raw.txt.sz")
+	fid, err := os.Create(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	wtr := snappy.NewBufferedWriter(fid)
+	defer wtr.Close()
+	rawout = wtr
+
+	files1, files2 := config.ReadFiles()
+	var bbuf bytes.Buffer
+	for k, fname1 := range files1 {
+		fname2 := ""
+		if len(files2) > 0 {
+			fname2 = files2[k]
 		}
-		bbuf.Write([]byte(rn))
+		readFile(&bbuf, k, fname1, fname2)
+		if config.MaxReads > 0 && nread >= config.MaxReads {
+			logger.Printf("Stopped after %d reads (MaxReads)", nread)
+			break
+		}
+	}
+	flushReservoir(&bbuf)
+
+	if config.SampleFraction > 0 || config.SampleCount > 0 {
+		logger.Printf("Sampled %d of %d reads using seed %d", nsampled, nread, config.SampleSeed)
+	}
+
+	if config.TrimQuality > 0 {
+		logger.Printf("Quality trimmed %d reads", ntrim)
+	}
+	if config.MaskQuality > 0 {
+		logger.Printf("Masked %d low quality bases", nmask)
+	}
+
+	if config.TrimPolyT {
+		logger.Printf("Trimmed poly-T heads from %d reads", npolyT)
+	}
+	if config.TrimPolyA {
+		logger.Printf("Trimmed poly-A tails from %d reads", npolyA)
+	}
+	if config.TrimHomopolymer {
+		logger.Printf("Trimmed other homopolymer tails from %d reads", nhomopolymer)
+	}
 
-		bbuf.Write([]byte("\n"))
+	if config.UMIPattern != "" || config.UMILength > 0 {
+		logger.Printf("Found UMIs for %d reads", numi)
+	}
 
-		_, err = os.Stdout.Write(bbuf.Bytes())
-		if err != nil {
-			panic(err)
+	if len(barcodes) > 0 {
+		done := make(map[string]bool)
+		for _, bc := range barcodes {
+			if !done[bc.sample] {
+				logger.Printf("Assigned %d reads to sample %s", sampleCounts[bc.sample], bc.sample)
+				done[bc.sample] = true
+			}
 		}
+		logger.Printf("%d reads could not be assigned to a sample", nunassigned)
+	}
+
+	for k, ad := range adapters {
+		logger.Printf("Adapter %s trimmed from %d reads", ad, adapterCounts[k])
+	}
+	for k, pr := range primers {
+		logger.Printf("Primer %s trimmed from %d reads", pr, primerCounts[k])
 	}
 
 	logger.Printf("Skipped %d reads for being too short", nskip)
 }
 
+// readFile processes the reads in one file, which may contain
+// interleaved pairs, or in a pair of files of first and second
+// mates.  The reads are tagged with the position of the file in the
+// list of read files.
+func readFile(bbuf *bytes.Buffer, ifile int, fname1, fname2 string) {
+
+	ris := utils.NewReadInSeq(fname1, "", config.ReadFormat)
+	defer ris.Close()
+	ris.Lenient = config.ReadValidation == "lenient"
+	logger.Printf("Reading %s format reads from %s", ris.Format, fname1)
+
+	// The second mate of each pair, for paired-end data.
+	var ris2 *utils.ReadInSeq
+	if fname2 != "" {
+		ris2 = utils.NewReadInSeq(fname2, "", config.ReadFormat)
+		defer ris2.Close()
+		ris2.Lenient = ris.Lenient
+		logger.Printf("Reading %s format mates from %s", ris2.Format, fname2)
+	}
+
+	// True if reading stopped early due to MaxReads
+	var limited bool
+
+	var lnum int
+	for lnum = 0; ris.Next(); lnum++ {
+
+		if config.MaxReads > 0 && nread >= config.MaxReads {
+			limited = true
+			break
+		}
+		nread++
+
+		mate1, mate2 := ris, ris2
+		switch {
+		case ris2 != nil:
+			if !ris2.Next() {
+				msg := fmt.Sprintf("%s has fewer reads than %s", fname2, fname1)
+				logger.Print(msg)
+				panic(msg)
+			}
+		case config.InterleavedPairs:
+			// The record following each first mate is its
+			// second mate.  Reading the second mate
+			// overwrites ris, so keep a copy of the first.
+			if ris.Mate != 1 {
+				msg := fmt.Sprintf("Pair %d of %s starts with '%s', which is not a first mate",
+					lnum+1, fname1, ris.Name)
+				logger.Print(msg)
+				panic(msg)
+			}
+			mate1 = copyRead(ris)
+			if !ris.Next() || ris.Mate != 2 {
+				msg := fmt.Sprintf("The first mate '%s' of pair %d of %s is not followed by its second mate",
+					mate1.Name, lnum+1, fname1)
+				logger.Print(msg)
+				panic(msg)
+			}
+			mate2 = ris
+		case ris.Mate != 0:
+			// runmatch did not see that the file is paired,
+			// e.g. because it is read from standard input.
+			msg := fmt.Sprintf("%s contains paired reads (read %d is '%s'), set InterleavedPairs "+
+				"or give the second mates in ReadFileName2", fname1, lnum+1, ris.Name)
+			logger.Print(msg)
+			panic(msg)
+		}
+
+		if mate2 != nil && mateBase(mate1.Name) != mateBase(mate2.Name) {
+			msg := fmt.Sprintf("Pair %d of %s has mate names '%s' and '%s', which do not agree",
+				lnum+1, fname1, mate1.Name, mate2.Name)
+			logger.Print(msg)
+			panic(msg)
+		}
+
+		sampleRead(bbuf, ifile, mate1, mate2)
+	}
+
+	if ris2 != nil {
+		if !limited && ris2.Next() {
+			msg := fmt.Sprintf("%s has more reads than %s", fname2, fname1)
+			logger.Print(msg)
+			panic(msg)
+		}
+		logger.Printf("Read %d pairs", lnum)
+	} else if config.InterleavedPairs {
+		logger.Printf("Read %d interleaved pairs", lnum)
+	} else {
+		logger.Printf("Read %d reads", lnum)
+	}
+
+	if ris.Lenient {
+		logger.Printf("Skipped %d malformed records in %s", ris.Skipped, fname1)
+		if ris2 != nil {
+			logger.Printf("Skipped %d malformed records in %s", ris2.Skipped, fname2)
+		}
+	}
+}
+
+// processRead tags a read (or a pair of reads if ris2 is not nil) with
+// its UMI and sample, and writes it to stdout.
+func processRead(bbuf *bytes.Buffer, ifile int, ris, ris2 *utils.ReadInSeq) {
+
+	tags := readTags{file: ifile}
+	var skip int
+	tags.umi, skip = extractUMI(ris)
+	if tags.umi != "" {
+		numi++
+	}
+
+	// Reads that cannot be assigned to a sample are not matched.
+	// They are written to the raw read file with an empty
+	// processed sequence, which no match has, so that they are
+	// written out with the unmatched reads.
+	if len(barcodes) > 0 {
+		var blen int
+		tags.sample, blen = assignSample(ris.Seq)
+		if tags.sample == "" {
+			nunassigned++
+			if ris2 == nil {
+				writeRaw(bbuf, nil, ris, 0)
+			} else {
+				writeRaw(bbuf, nil, ris, 1)
+				writeRaw(bbuf, nil, ris2, 2)
+			}
+			return
+		}
+		sampleCounts[tags.sample]++
+		if blen > skip {
+			skip = blen
+		}
+	} else if ris.Sample != "" {
+		// For SAM and BAM files, the read group identifies the
+		// sample.
+		tags.sample = strings.NewReplacer(":", "_", ",", "_").Replace(ris.Sample)
+	}
+
+	if ris2 == nil {
+		if !emit(bbuf, ris, readName(ris.Name), 0, skip, tags) {
+			nskip++
+		}
+		return
+	}
+
+	// The second mate is reverse complemented, so that both mates
+	// of a properly oriented pair match the same target strand.
+	// Both mates carry the UMI of the first mate.
+	base := mateBase(ris.Name)
+	if !emit(bbuf, ris, base+"/1", 1, skip, tags) {
+		nskip++
+	}
+	if !emit(bbuf, ris2, base+"/2", 2, 0, tags) {
+		nskip++
+	}
+}
+
 func setupLog() {
 	logname := path.Join(tmpdir, "prep_reads.log")
 	fid, err := os.Create(logname)
@@ -102,6 +505,29 @@ func main() {
 	}
 
 	config = utils.ReadConfig(os.Args[1])
+	if config.QualityOffset == 0 {
+		config.QualityOffset = 33
+	}
+	if config.AdapterMinOverlap == 0 {
+		config.AdapterMinOverlap = 3
+	}
+	if config.TailMinLength == 0 {
+		config.TailMinLength = 8
+	}
+	for _, x := range config.Adapters {
+		adapters = append(adapters, []byte(strings.ToUpper(x)))
+	}
+	for _, x := range config.Primers {
+		primers = append(primers, []byte(strings.ToUpper(x)))
+	}
+	adapterCounts = make([]int, len(adapters))
+	primerCounts = make([]int, len(primers))
+	compileUMI()
+	rng = rand.New(rand.NewSource(config.SampleSeed))
+	if config.BarcodeFileName != "" {
+		readBarcodes()
+		sampleCounts = make(map[string]int)
+	}
 
 	if config.TempDir == "" {
 		tmpdir = os.Args[2]
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+
+	"github.com/kshedden/seqmatch/utils"
+)
+
+// A sampledRead is a read, or a pair of reads, held in the reservoir
+// until all reads have been seen.
+type sampledRead struct {
+	ifile  int
+	r1, r2 *utils.ReadInSeq
+}
+
+var (
+	// Random numbers for sampling, seeded with SampleSeed so that
+	// the same reads are selected in every run
+	rng *rand.Rand
+
+	// The reads selected so far when sampling a fixed number of
+	// reads
+	reservoir []sampledRead
+
+	// The number of reads (or pairs) that have been selected
+	nsampled int
+)
+
+// copyRead returns a copy of the current read of ris.
+func copyRead(ris *utils.ReadInSeq) *utils.ReadInSeq {
+	if ris == nil {
+		return nil
+	}
+	return &utils.ReadInSeq{Name: ris.Name, Seq: ris.Seq, Qual: ris.Qual, Sep: ris.Sep,
+		Sample: ris.Sample}
+}
+
+// sampleRead decides whether a read (or pair) is used.  If
+// SampleFraction is set, each read is used with that probability.  If
+// SampleCount is set, a uniform random sample of SampleCount reads is
+// drawn using reservoir sampling, and the selected reads are
+// processed by flushReservoir once all reads have been seen.
+func sampleRead(bbuf *bytes.Buffer, ifile int, ris, ris2 *utils.ReadInSeq) {
+
+	switch {
+	case config.SampleCount > 0:
+		if len(reservoir) < config.SampleCount {
+			reservoir = append(reservoir, sampledRead{ifile, copyRead(ris), copyRead(ris2)})
+			return
+		}
+		// nread includes the current read
+		if j := rng.Intn(nread); j < config.SampleCount {
+			reservoir[j] = sampledRead{ifile, copyRead(ris), copyRead(ris2)}
+		}
+	case config.SampleFraction > 0:
+		if rng.Float64() < config.SampleFraction {
+			nsampled++
+			processRead(bbuf, ifile, ris, ris2)
+		}
+	default:
+		processRead(bbuf, ifile, ris, ris2)
+	}
+}
+
+// flushReservoir processes the reads selected by reservoir sampling.
+func flushReservoir(bbuf *bytes.Buffer) {
+	for _, r := range reservoir {
+		nsampled++
+		processRead(bbuf, r.ifile, r.r1, r.r2)
+	}
+	reservoir = nil
+}
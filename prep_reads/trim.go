@@ -0,0 +1,214 @@
+package main
+
+// qualTrim returns the number of bases that remain after trimming
+// low-quality bases from the 3' end of a read.  Bases are removed
+// while the mean quality of the window of TrimWindow bases ending at
+// the 3' end is less than TrimQuality.
+func qualTrim(qual []byte) int {
+
+	w := config.TrimWindow
+	if w < 1 {
+		w = 1
+	}
+
+	n := len(qual)
+	for n > 0 {
+		j := n - w
+		if j < 0 {
+			j = 0
+		}
+
+		var sum int
+		for _, q := range qual[j:n] {
+			sum += int(q) - config.QualityOffset
+		}
+		if sum >= config.TrimQuality*(n-j) {
+			break
+		}
+		n--
+	}
+
+	return n
+}
+
+// qualMask replaces bases having quality less than MaskQuality with
+// X, and returns the number of bases that were masked.
+func qualMask(seq, qual []byte) int {
+	var n int
+	for i, q := range qual {
+		if int(q)-config.QualityOffset < config.MaskQuality && seq[i] != 'X' {
+			seq[i] = 'X'
+			n++
+		}
+	}
+	return n
+}
+
+// upper returns the upper case form of a letter.  Reads may contain
+// lower case bases, which should match the (upper case) adapters,
+// primers and barcodes.
+func upper(c byte) byte {
+	if c >= 'a' && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
+
+// nmiss returns the number of positions at which x and y differ,
+// ignoring case, stopping early once the count exceeds maxmiss.
+func nmiss(x, y []byte, maxmiss int) int {
+	var n int
+	for i := range x {
+		if upper(x[i]) != upper(y[i]) {
+			n++
+			if n > maxmiss {
+				break
+			}
+		}
+	}
+	return n
+}
+
+// allowedMiss returns the number of mismatches allowed when an
+// adapter or primer overlaps a read in ov positions.  Partial
+// overlaps are allowed proportionally fewer mismatches.
+func allowedMiss(ov, alen int) int {
+	return config.AdapterMismatches * ov / alen
+}
+
+// adapterTrim returns the length of the read after removing a 3'
+// adapter, and the index of the adapter that was found, or -1 if no
+// adapter was found.  The adapter may run off the 3' end of the
+// read, as long as it overlaps the read in at least
+// AdapterMinOverlap positions.  The leftmost match over all adapters
+// is used.
+func adapterTrim(seq []byte) (int, int) {
+
+	n, ia := len(seq), -1
+
+	for k, ad := range adapters {
+		for i := 0; i < n; i++ {
+			ov := len(ad)
+			if len(seq)-i < ov {
+				ov = len(seq) - i
+			}
+			if ov < config.AdapterMinOverlap {
+				break
+			}
+			mx := allowedMiss(ov, len(ad))
+			if nmiss(seq[i:i+ov], ad[0:ov], mx) <= mx {
+				n, ia = i, k
+				break
+			}
+		}
+	}
+
+	return n, ia
+}
+
+// primerTrim returns the number of bases to remove from the 5' end
+// of a read to remove a primer, and the index of the primer that was
+// found, or -1 if no primer was found.  The read may start partway
+// through the primer, as long as at least AdapterMinOverlap primer
+// positions are present.  The longest match over all primers is
+// used.
+func primerTrim(seq []byte) (int, int) {
+
+	n, ip := 0, -1
+
+	for k, pr := range primers {
+		for j := 0; len(pr)-j >= config.AdapterMinOverlap; j++ {
+			ov := len(pr) - j
+			if ov > len(seq) || ov <= n {
+				continue
+			}
+			mx := allowedMiss(ov, len(pr))
+			if nmiss(seq[0:ov], pr[j:], mx) <= mx {
+				n, ip = ov, k
+				break
+			}
+		}
+	}
+
+	return n, ip
+}
+
+// tailRun returns the length of the longest run of letter b at the 3'
+// end of a read, allowing up to maxmiss other letters within the run.
+// The run must start with b, which is upper case, and the read may be
+// in either case.
+func tailRun(seq []byte, b byte, maxmiss int) int {
+
+	var n, miss int
+	for i := len(seq) - 1; i >= 0; i-- {
+		if upper(seq[i]) != b {
+			miss++
+			if miss > maxmiss {
+				break
+			}
+			continue
+		}
+		n = len(seq) - i
+	}
+
+	return n
+}
+
+// headRun returns the length of the longest run of letter b at the 5'
+// end of a read, allowing up to maxmiss other letters within the run.
+// The run must end with b, which is upper case, and the read may be
+// in either case.
+func headRun(seq []byte, b byte, maxmiss int) int {
+
+	var n, miss int
+	for i := 0; i < len(seq); i++ {
+		if upper(seq[i]) != b {
+			miss++
+			if miss > maxmiss {
+				break
+			}
+			continue
+		}
+		n = i + 1
+	}
+
+	return n
+}
+
+// polyTrim returns the number of bases to remove from the 5' and 3'
+// ends of a read to remove poly-T heads, poly-A tails and homopolymer
+// tails, as selected by TrimPolyT, TrimPolyA and TrimHomopolymer.
+// Runs shorter than TailMinLength are not trimmed.
+func polyTrim(seq []byte) (int, int) {
+
+	var head, tail int
+
+	if config.TrimPolyT {
+		if n := headRun(seq, 'T', config.TailMismatches); n >= config.TailMinLength {
+			head = n
+			npolyT++
+		}
+	}
+
+	if config.TrimPolyA {
+		if n := tailRun(seq[head:], 'A', config.TailMismatches); n >= config.TailMinLength {
+			tail = n
+			npolyA++
+		}
+	}
+
+	if config.TrimHomopolymer {
+		var mx int
+		for _, b := range []byte("ACGT") {
+			if n := tailRun(seq[head:], b, config.TailMismatches); n > mx {
+				mx = n
+			}
+		}
+		if mx >= config.TailMinLength && mx > tail {
+			tail = mx
+			nhomopolymer++
+		}
+	}
+
+	return head, tail
+}
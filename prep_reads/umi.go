@@ -0,0 +1,62 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/kshedden/seqmatch/utils"
+)
+
+// readTags holds the values that are attached to each read, in
+// addition to its name, and carried through to the results.
+type readTags struct {
+
+	// The unique molecular identifier, blank if UMIs are not used
+	umi string
+
+	// The sample identified by the barcode of the read, blank if
+	// barcodes are not used
+	sample string
+
+	// The position of the file containing the read in the list of
+	// read files
+	file int
+}
+
+// extractUMI returns the UMI of a read, and the number of bases that
+// must be removed from the 5' end of the read because they contain
+// the UMI.
+func extractUMI(ris *utils.ReadInSeq) (string, int) {
+
+	if config.UMILength > 0 {
+		end := config.UMIStart + config.UMILength
+		if end > len(ris.Seq) {
+			// The read is too short to contain the UMI, so
+			// nothing remains after removing it.
+			return "", len(ris.Seq)
+		}
+		return strings.ToUpper(ris.Seq[config.UMIStart:end]), end
+	}
+
+	if umiRegexp == nil {
+		return "", 0
+	}
+
+	m := umiRegexp.FindStringSubmatch(ris.Name)
+	switch {
+	case m == nil:
+		return "", 0
+	case len(m) > 1:
+		return m[1], 0
+	default:
+		return m[0], 0
+	}
+}
+
+// compileUMI prepares the regular expression used to extract UMIs from
+// read names.
+func compileUMI() {
+	if config.UMIPattern != "" {
+		umiRegexp = regexp.MustCompile(config.UMIPattern)
+	}
+}
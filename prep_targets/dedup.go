@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/kshedden/seqmatch/utils"
+)
+
+// deduper collapses duplicated target sequences.  The sequences are
+// sorted with the external sort program so that duplicates are
+// adjacent, which allows databases that are too large to fit in
+// memory to be deduplicated.  Each collapsed target is written at the
+// position of its first occurrence, and its id is a list of the ids
+// of all the sequences that it replaces, separated by semicolons.
+// When deduplicating reverse complements, the ids of sequences that
+// are the reverse complement of the target have _r appended.
+//
+// When appending to a bundle, the existing targets are also added
+// (see seed), and appended sequences that duplicate an existing target
+// are merged into its id row rather than written as new rows.
+type deduper struct {
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	wtr *bufio.Writer
+	out io.ReadCloser
+
+	// The number of sequences added so far
+	n int
+
+	// The row number of the first new target.  Existing targets
+	// are added using their row numbers, which are smaller.
+	start int
+}
+
+// sortCmd starts sort with the given arguments, using byte order.
+func sortCmd(args ...string) (*exec.Cmd, io.WriteCloser, io.ReadCloser) {
+
+	cmd := exec.Command("sort", append([]string{"-S", "2G", "-t\t"}, args...)...)
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	cmd.Stderr = os.Stderr
+
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		panic(err)
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		panic(err)
+	}
+	if err := cmd.Start(); err != nil {
+		panic(err)
+	}
+
+	return cmd, in, out
+}
+
+func newDeduper() *deduper {
+
+	dd := &deduper{start: nseq}
+
+	// Sort by sequence, then by position in the input
+	dd.cmd, dd.in, dd.out = sortCmd("-k1,1", "-k2,2n")
+	dd.wtr = bufio.NewWriter(dd.in)
+
+	return dd
+}
+
+// dedupKey returns the sequence, or in revcomp mode the smaller of the
+// sequence and its reverse complement.
+func dedupKey(seq []byte) []byte {
+	if dedup == "revcomp" {
+		if r := utils.RevComp(seq); bytes.Compare(r, seq) < 0 {
+			return r
+		}
+	}
+	return seq
+}
+
+// add adds one sequence.  Each line passed to sort contains the key
+// (see dedupKey), the position, sequence, id, source, metadata and
+// the ids of the reverse complement row (only used for existing
+// targets).
+func (dd *deduper) add(name string, seq []byte, source, meta string) {
+
+	_, err := fmt.Fprintf(dd.wtr, "%s\t%d\t%s\t%s\t%s\t%s\t-\n", dedupKey(seq), dd.start+dd.n, seq,
+		name, source, meta)
+	if err != nil {
+		panic(err)
+	}
+	dd.n++
+}
+
+// seed adds an existing target of a bundle that is being appended to,
+// from the given row.  The ids, sources and metadata are those of the
+// row, and rnames holds the ids of its reverse complement row, or "-"
+// if there is none.
+func (dd *deduper) seed(row int, seq, names, rnames, sources, meta string) {
+
+	_, err := fmt.Fprintf(dd.wtr, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n", dedupKey([]byte(seq)), row, seq,
+		names, sources, meta, rnames)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// joinMeta joins the metadata of the sequences collapsed into one
+// target, separated by |.  If none of them have metadata, it returns
+// "-".
+func joinMeta(metas []string) string {
+	for _, m := range metas {
+		if m != "-" {
+			return strings.Join(metas, "|")
+		}
+	}
+	return "-"
+}
+
+// finish groups the sorted sequences and writes one target for each
+// distinct sequence, in the order of their first occurrence.  Groups
+// that start with an existing target are not written, if they contain
+// new sequences the merged id rows are placed in merged.
+func (dd *deduper) finish(tw *targetWriter) {
+
+	if err := dd.wtr.Flush(); err != nil {
+		panic(err)
+	}
+	dd.in.Close()
+
+	// Restore the input order, using the position of the first
+	// sequence in each group.  Each line contains the position,
+	// sequence, ids, ids of the reverse complement, sources and
+	// metadata.
+	cmd2, in2, out2 := sortCmd("-k1,1n")
+	wtr2 := bufio.NewWriter(in2)
+
+	var key, seq string
+	var first, nnew int
+	var names, rnames, sources, metas []string
+	var ntarget, nmerged int
+	flush := func() {
+		if first < dd.start {
+			if nnew == 0 {
+				return
+			}
+			nmerged += nnew
+			idline := func(names []string) string {
+				return fmt.Sprintf("%s\t%d\t%s\t%s", strings.Join(names, ";"), len(seq),
+					strings.Join(sources, ";"), joinMeta(metas))
+			}
+			merged[first] = idline(names)
+			if tw.rev {
+				merged[first+1] = idline(rnames)
+			}
+			return
+		}
+		ntarget++
+		_, err := fmt.Fprintf(wtr2, "%d\t%s\t%s\t%s\t%s\t%s\n", first, seq, strings.Join(names, ";"),
+			strings.Join(rnames, ";"), strings.Join(sources, ";"), joinMeta(metas))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var ngroup int
+	scanner := bufio.NewScanner(dd.out)
+	scanner.Buffer(make([]byte, 4*maxline), 4*maxline)
+	for scanner.Scan() {
+		f := strings.Split(scanner.Text(), "\t")
+		pos, err := strconv.Atoi(f[1])
+		if err != nil {
+			panic(err)
+		}
+		if f[0] != key || ngroup == 0 {
+			if ngroup > 0 {
+				flush()
+			}
+			ngroup++
+			key, seq = f[0], f[2]
+			first = pos
+			nnew = 0
+			names = names[0:0]
+			rnames = rnames[0:0]
+			sources = sources[0:0]
+			metas = metas[0:0]
+		}
+
+		// Existing targets keep their ids, one metadata
+		// value is needed for each id.
+		if pos < dd.start {
+			names = append(names, f[3])
+			rnames = append(rnames, f[6])
+			sources = append(sources, f[4])
+			n := strings.Count(f[3], ";") + 1
+			if f[5] == "-" {
+				for j := 0; j < n; j++ {
+					metas = append(metas, "-")
+				}
+			} else {
+				metas = append(metas, strings.Split(f[5], "|")...)
+			}
+			continue
+		}
+		nnew++
+
+		// Sequences that are the reverse complement of the
+		// target are marked with _r.
+		if f[2] == seq {
+			names = append(names, f[3])
+			rnames = append(rnames, f[3]+"_r")
+		} else {
+			names = append(names, f[3]+"_r")
+			rnames = append(rnames, f[3])
+		}
+		sources = append(sources, f[4])
+		metas = append(metas, f[5])
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+	if ngroup > 0 {
+		flush()
+	}
+	if err := dd.cmd.Wait(); err != nil {
+		panic(err)
+	}
+
+	if err := wtr2.Flush(); err != nil {
+		panic(err)
+	}
+	in2.Close()
+
+	scanner = bufio.NewScanner(out2)
+	scanner.Buffer(make([]byte, 4*maxline), 4*maxline)
+	for scanner.Scan() {
+		f := strings.Split(scanner.Text(), "\t")
+		seq := []byte(f[1])
+		tw.write(f[2], seq, f[4], f[5])
+		if tw.rev {
+			tw.write(f[3], utils.RevComp(seq), f[4], f[5])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+	if err := cmd2.Wait(); err != nil {
+		panic(err)
+	}
+
+	logger.Printf("Collapsed %d sequences into %d targets", dd.n-nmerged, ntarget)
+	if nmerged > 0 {
+		logger.Printf("Merged %d sequences into existing targets", nmerged)
+	}
+}
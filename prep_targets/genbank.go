@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kshedden/seqmatch/utils"
+)
+
+// feature is one entry of the feature table of a GenBank or EMBL
+// record.
+type feature struct {
+
+	// The feature key, e.g. CDS or gene
+	key string
+
+	// The location, e.g. complement(join(100..200,300..400))
+	location string
+
+	// The qualifiers in the order that they appear, as name/value
+	// pairs.  Qualifiers without a value have an empty value.
+	quals [][2]string
+}
+
+// qualifier returns the value of the first qualifier with the given
+// name, and false if there is no such qualifier.
+func (f *feature) qualifier(name string) (string, bool) {
+	for _, q := range f.quals {
+		if q[0] == name {
+			return q[1], true
+		}
+	}
+	return "", false
+}
+
+// flatRecord is one record from a GenBank or EMBL flat file.
+type flatRecord struct {
+	name     string
+	seq      []byte
+	features []*feature
+}
+
+// addFeatureLine adds a line of the feature table, with the feature
+// key starting in column 6 and the location or qualifiers starting in
+// column 22 (as in GenBank files, EMBL lines are converted to this
+// layout by the caller).
+func (rec *flatRecord) addFeatureLine(line string) {
+
+	if len(line) < 21 {
+		return
+	}
+
+	// A new feature
+	if line[5] != ' ' {
+		f := &feature{
+			key:      strings.TrimSpace(line[5:21]),
+			location: strings.TrimSpace(line[21:]),
+		}
+		rec.features = append(rec.features, f)
+		return
+	}
+
+	if len(rec.features) == 0 {
+		return
+	}
+	f := rec.features[len(rec.features)-1]
+	text := strings.TrimSpace(line[21:])
+
+	switch {
+	case strings.HasPrefix(text, "/"):
+		// A new qualifier
+		q := strings.SplitN(text[1:], "=", 2)
+		if len(q) == 1 {
+			q = append(q, "")
+		}
+		f.quals = append(f.quals, [2]string{q[0], q[1]})
+	case len(f.quals) == 0:
+		// The location continues
+		f.location += text
+	default:
+		// The value of the last qualifier continues
+		q := &f.quals[len(f.quals)-1]
+		q[1] += " " + text
+	}
+}
+
+// addSeqLine adds the letters from a line of the sequence section of
+// a record, skipping the position numbers and spaces.  GenBank and
+// EMBL files write sequences in lower case, so the letters are upper
+// cased and -mask does not apply to them.
+func (rec *flatRecord) addSeqLine(line []byte) {
+	for _, c := range line {
+		if c >= 'a' && c <= 'z' {
+			rec.seq = append(rec.seq, c-'a'+'A')
+		} else if c >= 'A' && c <= 'Z' {
+			rec.seq = append(rec.seq, c)
+		}
+	}
+}
+
+// parseFlat reads GenBank (if embl is false) or EMBL records, calling
+// emit for each complete record.
+func parseFlat(scanner *bufio.Scanner, embl bool, emit func(*flatRecord)) {
+
+	rec := new(flatRecord)
+	var infeatures, inseq bool
+
+	for scanner.Scan() {
+
+		line := bytes.TrimRight(scanner.Bytes(), "\r")
+		if len(line) == 0 {
+			continue
+		}
+
+		if bytes.HasPrefix(line, []byte("//")) {
+			emit(rec)
+			rec = new(flatRecord)
+			infeatures, inseq = false, false
+			continue
+		}
+
+		if embl {
+			if len(line) < 2 {
+				continue
+			}
+			code := string(line[0:2])
+			switch {
+			case code == "ID":
+				if f := strings.Fields(string(line[2:])); len(f) > 0 {
+					rec.name = strings.TrimRight(f[0], ";")
+				}
+			case code == "FT":
+				rec.addFeatureLine("  " + string(line[2:]))
+			case code == "SQ":
+				inseq = true
+			case code == "  " && inseq:
+				rec.addSeqLine(line)
+			}
+			continue
+		}
+
+		// GenBank section keywords start in the first column
+		if line[0] != ' ' {
+			infeatures, inseq = false, false
+			switch {
+			case bytes.HasPrefix(line, []byte("LOCUS")):
+				if f := strings.Fields(string(line)); len(f) > 1 {
+					rec.name = f[1]
+				}
+			case bytes.HasPrefix(line, []byte("FEATURES")):
+				infeatures = true
+			case bytes.HasPrefix(line, []byte("ORIGIN")):
+				inseq = true
+			}
+			continue
+		}
+
+		switch {
+		case infeatures:
+			rec.addFeatureLine(string(line))
+		case inseq:
+			rec.addSeqLine(line)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	// A final record without a terminating // line
+	if len(rec.seq) > 0 {
+		emit(rec)
+	}
+}
+
+// splitTop splits s at the commas that are not within parentheses.
+func splitTop(s string) []string {
+
+	var parts []string
+	var depth, last int
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[last:i])
+				last = i + 1
+			}
+		}
+	}
+
+	return append(parts, s[last:])
+}
+
+// extract returns the part of seq given by a feature location.
+// Positions are one-based and inclusive.  Locations referring to
+// other records, and locations between two bases (e.g. 100^101), are
+// not supported.
+func extract(loc string, seq []byte) ([]byte, error) {
+
+	loc = strings.TrimSpace(loc)
+
+	switch {
+	case strings.HasPrefix(loc, "complement(") && strings.HasSuffix(loc, ")"):
+		x, err := extract(loc[11:len(loc)-1], seq)
+		if err != nil {
+			return nil, err
+		}
+		return utils.RevComp(x), nil
+	case strings.HasPrefix(loc, "join(") && strings.HasSuffix(loc, ")"),
+		strings.HasPrefix(loc, "order(") && strings.HasSuffix(loc, ")"):
+		i := strings.Index(loc, "(")
+		var x []byte
+		for _, part := range splitTop(loc[i+1 : len(loc)-1]) {
+			y, err := extract(part, seq)
+			if err != nil {
+				return nil, err
+			}
+			x = append(x, y...)
+		}
+		return x, nil
+	case strings.Contains(loc, ":"):
+		return nil, fmt.Errorf("location %s refers to another record", loc)
+	case strings.Contains(loc, "^"):
+		return nil, fmt.Errorf("location %s is between two bases", loc)
+	}
+
+	f := strings.SplitN(strings.Trim(loc, "<>"), "..", 2)
+	if len(f) == 1 {
+		f = append(f, f[0])
+	}
+	start, err1 := strconv.Atoi(strings.Trim(f[0], "<>"))
+	end, err2 := strconv.Atoi(strings.Trim(f[1], "<>"))
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("unable to parse location %s", loc)
+	}
+	if start < 1 || end < start || end > len(seq) {
+		return nil, fmt.Errorf("location %s is outside the sequence", loc)
+	}
+
+	return append([]byte{}, seq[start-1:end]...), nil
+}
+
+var locationNumber = regexp.MustCompile(`[0-9]+`)
+
+// span returns the smallest and largest positions in a location, and
+// the strand.
+func span(loc string) (int, int, byte) {
+
+	var start, end int
+	for _, s := range locationNumber.FindAllString(loc, -1) {
+		x, _ := strconv.Atoi(s)
+		if start == 0 || x < start {
+			start = x
+		}
+		if x > end {
+			end = x
+		}
+	}
+
+	strand := byte('+')
+	if strings.Contains(loc, "complement(") {
+		strand = '-'
+	}
+
+	return start, end, strand
+}
+
+// metaValue makes a qualifier value safe for use in the metadata
+// column of the id file.
+var metaValue = strings.NewReplacer("\"", "", "\t", " ", ";", ",")
+
+// featureMeta returns the metadata column for a feature, containing
+// the record name, the feature type and coordinates, and the
+// qualifiers, as name=value pairs separated by semicolons.  The
+// translation qualifier is omitted, and qualifiers without a value
+// (e.g. /pseudo) appear as a name alone.
+func featureMeta(rec *flatRecord, f *feature) string {
+
+	start, end, strand := span(f.location)
+	m := []string{
+		"record=" + rec.name,
+		"type=" + f.key,
+		"location=" + f.location,
+		fmt.Sprintf("start=%d", start),
+		fmt.Sprintf("end=%d", end),
+		fmt.Sprintf("strand=%c", strand),
+	}
+
+	for _, q := range f.quals {
+		if q[0] == "translation" {
+			continue
+		}
+		if q[1] == "" {
+			m = append(m, q[0])
+		} else {
+			m = append(m, q[0]+"="+metaValue.Replace(q[1]))
+		}
+	}
+
+	return strings.Join(m, ";")
+}
+
+func processFlat(scanner *bufio.Scanner, tw *targetWriter, embl bool, source string) {
+
+	if embl {
+		logger.Printf("Processing EMBL format file %s...", source)
+	} else {
+		logger.Printf("Processing GenBank format file %s...", source)
+	}
+
+	// The sequences are upper cased when they are read, as their
+	// case does not mark repeats.
+	if mask != "upper" {
+		logger.Printf("-mask=%s is ignored for %s, its sequences are read in upper case", mask, source)
+	}
+
+	var nrec int
+	parseFlat(scanner, embl, func(rec *flatRecord) {
+
+		nrec++
+		if nrec%100000 == 0 {
+			logger.Printf("%d\n", nrec)
+		}
+
+		if len(features) == 0 {
+			tw.add(rec.name, rec.seq, source, "-")
+			return
+		}
+
+		for _, f := range rec.features {
+			if !features[f.key] {
+				continue
+			}
+
+			seq, err := extract(f.location, rec.seq)
+			if err != nil {
+				logger.Printf("Skipping %s feature in %s: %v", f.key, rec.name, err)
+				continue
+			}
+
+			name, ok := f.qualifier(qualifier)
+			if ok {
+				name = metaValue.Replace(name)
+			} else {
+				start, end, _ := span(f.location)
+				name = fmt.Sprintf("%s:%s:%d-%d", rec.name, f.key, start, end)
+			}
+
+			tw.add(name, seq, source, featureMeta(rec, f))
+		}
+	})
+}
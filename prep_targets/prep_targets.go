@@ -1,10 +1,23 @@
-// prep_targets converts a gene sequence file to a simple text format
+// prep_targets converts gene sequence files to a simple text format
 // used internally by Muscato.  The ids and sequences are placed into
 // newline-delimited text files, with one id or sequence per row.
+// Each id row also contains the sequence length, the name of the file
+// that the sequence came from, and a metadata column.
 //
-// The input can be either a fasta file, or a text format with each
-// line containing an id followed by a tab followed by a sequence.
-// Letters other than A/T/G/C are replaced with X.
+// The inputs can be fasta files, GenBank or EMBL flat files, or a text
+// format with each line containing an id followed by a tab followed by
+// a sequence.  The format is detected from the contents of each file,
+// and files compressed with gzip, bzip2 or zstd are decompressed.
+// Directories are searched for input files.  All the inputs are
+// combined into a single pair of output files.
+//
+// Features of GenBank and EMBL records (e.g. CDS) can be extracted as
+// separate targets, with their coordinates and qualifiers placed in
+// the metadata column.
+//
+// IUPAC ambiguity codes (e.g. R, Y, N) are retained, other letters
+// are replaced with X.  Lower case (soft-masked) letters are handled
+// as selected by the -mask flag.
 
 package main
 
@@ -16,10 +29,13 @@ import (
 	"io"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/golang/snappy"
+	"github.com/kshedden/seqmatch/utils"
 )
 
 const (
@@ -29,52 +45,103 @@ const (
 )
 
 var (
-	// If true, data are fasta format, else they follow a format
-	// with one line per sequence, having format id<tab>sequence.
-	fasta bool
+	// The output files are named using this prefix, followed by
+	// .txt.sz and _ids.txt.sz.
+	out string
 
-	logger *log.Logger
-)
+	// The GenBank/EMBL feature types (e.g. CDS or gene) that are
+	// extracted as targets.  If empty, the full records are used.
+	features map[string]bool
 
-// revcomp reverse complements its argument.
-func revcomp(seq []byte) []byte {
-	m := len(seq) - 1
-	b := make([]byte, len(seq))
-	for i, x := range seq {
-		switch x {
-		case 'A':
-			b[m-i] = 'T'
-		case 'T':
-			b[m-i] = 'A'
-		case 'G':
-			b[m-i] = 'C'
-		case 'C':
-			b[m-i] = 'G'
-		case 'X':
-			b[m-i] = 'X'
+	// The qualifier used to name extracted features.
+	qualifier string
 
-		}
-	}
-	return b
-}
+	// Either "none", "exact" (sequences that are identical are
+	// collapsed into one target) or "revcomp" (sequences that are
+	// identical or reverse complements of each other are
+	// collapsed).
+	dedup string
+
+	// The number of sequences written so far, used to number the
+	// rows of the output files, and their total length.
+	nseq   int
+	nbases int64
+
+	// If not empty, the outputs are written into a bundle in this
+	// directory, with a manifest describing them.
+	bundle string
+
+	// The input files, recorded in the manifest of a bundle.
+	sources []utils.BundleFile
+
+	// If true, the sequences are appended to an existing bundle.
+	appending bool
 
-// subx replaces non A/T/G/C with X
+	// When appending to a deduplicated bundle, the id rows (without
+	// the row number) of existing targets that appended sequences
+	// were merged into, by row number.
+	merged = make(map[int]string)
+
+	// How lower case (soft-masked) letters are handled, either
+	// "upper" (converted to upper case), "hard" (replaced with X)
+	// or "exclude-seeds" (retained, and may match reads but are
+	// never used as exact-match windows).
+	mask string
+
+	logger *log.Logger
+)
+
+// subx replaces letters that are not IUPAC nucleotide codes with X.
+// Ambiguity codes such as R, Y and N are retained, and match any read
+// base that they include.  Lower case (soft-masked) letters are
+// handled according to the masking mode.
 func subx(seq []byte) {
 	for i, c := range seq {
-		switch c {
-		case 'A':
-		case 'T':
-		case 'C':
-		case 'G':
+		switch {
+		case utils.IsIUPAC(c):
+		case mask == "upper" && utils.IsSoftMasked(c):
+			seq[i] = c - 'a' + 'A'
+		case mask == "exclude-seeds" && utils.IsSoftMasked(c):
 		default:
 			seq[i] = 'X'
 		}
 	}
 }
 
-func processText(scanner *bufio.Scanner, idout, seqout io.Writer, rev bool) {
+// detectFormat returns "fasta" if the first non-blank line of the
+// data starts with '>', "genbank" if it starts with LOCUS, "embl" if
+// it starts with ID, "tab" if it contains a tab, or an empty string if
+// the format is not recognized.
+func detectFormat(br *bufio.Reader) string {
+
+	// Peek returns an error if the file is shorter than the
+	// requested number of bytes, in which case we look at whatever
+	// is available.
+	buf, _ := br.Peek(4096)
+
+	for _, line := range bytes.Split(buf, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		switch {
+		case len(line) == 0:
+			continue
+		case line[0] == '>':
+			return "fasta"
+		case bytes.HasPrefix(line, []byte("LOCUS ")):
+			return "genbank"
+		case bytes.HasPrefix(line, []byte("ID   ")):
+			return "embl"
+		case bytes.IndexByte(line, '\t') > 0:
+			return "tab"
+		}
+		break
+	}
+
+	return ""
+}
+
+func processText(scanner *bufio.Scanner, tw *targetWriter, source string) {
 
-	logger.Print("Processing text format file...")
+	logger.Printf("Processing text format file %s...", source)
 
 	for lnum := 0; scanner.Scan(); lnum++ {
 
@@ -90,31 +157,7 @@ func processText(scanner *bufio.Scanner, idout, seqout io.Writer, rev bool) {
 		nam := toks[0]
 		seq := toks[1]
 
-		subx(seq)
-
-		// Write the sequence
-		_, err := seqout.Write(append(seq, '\n'))
-		if err != nil {
-			panic(err)
-		}
-		if rev {
-			_, err := seqout.Write(append(revcomp(seq), '\n'))
-			if err != nil {
-				panic(err)
-			}
-		}
-
-		// Write the gene id
-		_, err = idout.Write([]byte(fmt.Sprintf("%011d\t%s\t%d\n", lnum, nam, len(seq))))
-		if err != nil {
-			panic(err)
-		}
-		if rev {
-			_, err = idout.Write([]byte(fmt.Sprintf("%011d\t%s_r\t%d\n", lnum, nam, len(seq))))
-			if err != nil {
-				panic(err)
-			}
-		}
+		tw.add(string(nam), seq, source, "-")
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -122,53 +165,27 @@ func processText(scanner *bufio.Scanner, idout, seqout io.Writer, rev bool) {
 	}
 }
 
-func processFasta(scanner *bufio.Scanner, idout, seqout io.Writer, rev bool) {
+func processFasta(scanner *bufio.Scanner, tw *targetWriter, source string) {
 
-	logger.Print("Processing FASTA format file...")
+	logger.Printf("Processing FASTA format file %s...", source)
 
 	var seqname string
 	var seq []byte
-	var lnum int
-
-	flush := func(r bool) {
-
-		// Write the sequence
-		_, err := seqout.Write(append(seq, '\n'))
-		if err != nil {
-			panic(err)
-		}
 
-		// Write the gene id
-		if r {
-			_, err = idout.Write([]byte(fmt.Sprintf("%011d\t%s_r\t%d\n", lnum, seqname, len(seq))))
-			if err != nil {
-				panic(err)
-			}
-		} else {
-			_, err = idout.Write([]byte(fmt.Sprintf("%011d\t%s\t%d\n", lnum, seqname, len(seq))))
-			if err != nil {
-				panic(err)
-			}
-		}
-		lnum++
-	}
-
-	for scanner.Scan() {
+	for lnum := 0; scanner.Scan(); lnum++ {
 
 		if lnum%1000000 == 0 {
 			logger.Printf("%d\n", lnum)
 		}
 
-		line := scanner.Bytes()
+		line := bytes.TrimRight(scanner.Bytes(), "\r")
+		if len(line) == 0 {
+			continue
+		}
 
 		if line[0] == '>' {
 			if len(seq) > 0 {
-				subx(seq)
-				flush(false)
-				if rev {
-					seq = revcomp(seq)
-					flush(true)
-				}
+				tw.add(seqname, seq, source, "-")
 			}
 			seqname = string(line)
 			seq = seq[0:0]
@@ -183,58 +200,276 @@ func processFasta(scanner *bufio.Scanner, idout, seqout io.Writer, rev bool) {
 	}
 
 	if len(seq) > 0 {
-		flush(false)
-		if rev {
-			seq = revcomp(seq)
-			flush(true)
-		}
+		tw.add(seqname, seq, source, "-")
+	}
+}
+
+// targetWriter writes the target sequences and their ids, adding the
+// reverse complement sequences and collapsing duplicated sequences if
+// requested.
+type targetWriter struct {
+	idout  io.Writer
+	seqout io.Writer
+
+	// If true, the reverse complement of each sequence is also
+	// written, with _r appended to its id.
+	rev bool
+
+	// Collects the sequences when deduplicating, otherwise nil.
+	dd *deduper
+}
+
+// add adds one target sequence.  The metadata is "-" for sequences
+// that have no metadata.
+func (tw *targetWriter) add(name string, seq []byte, source, meta string) {
+
+	subx(seq)
+
+	if tw.dd != nil {
+		tw.dd.add(name, seq, source, meta)
+		return
+	}
+
+	tw.write(name, seq, source, meta)
+	if tw.rev {
+		tw.write(name+"_r", utils.RevComp(seq), source, meta)
 	}
 }
 
-func targets(genefile string, rev bool) {
+// write writes one sequence and its id line.  The rows of the two
+// output files are numbered consecutively across all input files.
+func (tw *targetWriter) write(name string, seq []byte, source, meta string) {
 
-	// Setup for reading the input file
-	inf, err := os.Open(genefile)
+	_, err := tw.seqout.Write(append(seq, '\n'))
 	if err != nil {
 		panic(err)
 	}
-	defer inf.Close()
 
-	// Setup for writing the sequence output
-	ext := filepath.Ext(genefile)
-	geneoutfile := strings.Replace(genefile, ext, ".txt.sz", 1)
-	gid1, err := os.Create(geneoutfile)
+	_, err = tw.idout.Write([]byte(fmt.Sprintf("%011d\t%s\t%d\t%s\t%s\n", nseq, name, len(seq), source, meta)))
 	if err != nil {
 		panic(err)
 	}
+
+	nseq++
+	nbases += int64(len(seq))
+}
+
+// close writes the deduplicated sequences, if deduplicating.
+func (tw *targetWriter) close() {
+	if tw.dd != nil {
+		tw.dd.finish(tw)
+	}
+}
+
+// inputFiles expands the command line arguments into a list of
+// files.  Directories are searched recursively, and files within them
+// whose format is not recognized are skipped.  The second value is
+// true for files that were found in a directory.
+func inputFiles(args []string) ([]string, []bool) {
+
+	var files []string
+	var indir []bool
+	for _, a := range args {
+		fi, err := os.Stat(a)
+		if err != nil {
+			panic(err)
+		}
+		if !fi.IsDir() {
+			files = append(files, a)
+			indir = append(indir, false)
+			continue
+		}
+
+		// Walk visits the files in lexical order
+		err = filepath.Walk(a, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".") {
+				files = append(files, p)
+				indir = append(indir, true)
+			}
+			return nil
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	return files, indir
+}
+
+// outputPrefix returns the path and base name of the output files.
+// If there is a single input file named e.g. genes.fasta.gz, the
+// outputs are genes.txt.sz and genes_ids.txt.sz in the same directory.
+func outputPrefix(args []string) string {
+
+	if bundle != "" {
+		return path.Join(bundle, "targets")
+	}
+	if out != "" {
+		return out
+	}
+
+	if len(args) != 1 {
+		return ""
+	}
+	if fi, err := os.Stat(args[0]); err != nil || fi.IsDir() {
+		return ""
+	}
+
+	name := args[0]
+	for _, ext := range []string{".gz", ".bz2", ".zst"} {
+		if strings.HasSuffix(strings.ToLower(name), ext) {
+			name = name[0 : len(name)-len(ext)]
+			break
+		}
+	}
+
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// createOutput creates an output file, or when appending to a bundle,
+// opens it for appending.  Snappy streams can be concatenated, so the
+// new rows are written as a second stream at the end of the file.
+func createOutput(fname string) *os.File {
+
+	var fid *os.File
+	var err error
+	if appending {
+		fid, err = os.OpenFile(fname, os.O_WRONLY|os.O_APPEND, 0)
+	} else {
+		fid, err = os.Create(fname)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	return fid
+}
+
+func targets(args []string, rev bool) {
+
+	prefix := outputPrefix(args)
+	if prefix == "" {
+		os.Stderr.WriteString("prep_targets: -out must be given when there are several input files or a directory\n")
+		os.Exit(1)
+	}
+
+	// The existing targets are read before the outputs are opened
+	// for appending.
+	var dd *deduper
+	if dedup != "none" {
+		dd = newDeduper()
+		if appending {
+			seedDeduper(dd, rev)
+		}
+	}
+
+	// Setup for writing the sequence output
+	geneoutfile := prefix + ".txt.sz"
+	gid1 := createOutput(geneoutfile)
 	defer gid1.Close()
 	seqout := snappy.NewBufferedWriter(gid1)
 	defer seqout.Close()
 
 	// Setup for writing the identifier output
-	geneidfile := strings.Replace(genefile, ext, "_ids.txt.sz", 1)
-	idwtr, err := os.Create(geneidfile)
-	if err != nil {
-		panic(err)
-	}
+	geneidfile := prefix + "_ids.txt.sz"
+	idwtr := createOutput(geneidfile)
 	defer idwtr.Close()
 	idout := snappy.NewBufferedWriter(idwtr)
 	defer idout.Close()
 
-	// Setup a scanner to read long lines
-	scanner := bufio.NewScanner(inf)
-	sbuf := make([]byte, maxline)
-	scanner.Buffer(sbuf, maxline)
+	tw := &targetWriter{idout: idout, seqout: seqout, rev: rev, dd: dd}
 
-	if fasta {
-		processFasta(scanner, idout, seqout, rev)
-	} else {
-		processText(scanner, idout, seqout, rev)
+	files, indir := inputFiles(args)
+	for k, genefile := range files {
+
+		// Skip the output files if they are in an input directory
+		if genefile == geneoutfile || genefile == geneidfile {
+			continue
+		}
+
+		inf, err := os.Open(genefile)
+		if err != nil {
+			panic(err)
+		}
+		rdr := utils.Decompress(inf)
+		br := bufio.NewReader(rdr)
+
+		format := detectFormat(br)
+		if format == "" {
+			inf.Close()
+			if indir[k] {
+				logger.Printf("Skipping %s, which is not in a recognized format", genefile)
+				continue
+			}
+			msg := fmt.Sprintf("prep_targets: %s is not in a recognized format\n", genefile)
+			os.Stderr.WriteString(msg)
+			os.Exit(1)
+		}
+
+		// Setup a scanner to read long lines
+		scanner := bufio.NewScanner(br)
+		sbuf := make([]byte, maxline)
+		scanner.Buffer(sbuf, maxline)
+
+		switch format {
+		case "fasta":
+			processFasta(scanner, tw, genefile)
+		case "genbank", "embl":
+			processFlat(scanner, tw, format == "embl", genefile)
+		default:
+			processText(scanner, tw, genefile)
+		}
+
+		rdr.Close()
+		inf.Close()
+
+		if bundle != "" {
+			sources = append(sources, utils.NewBundleFile(genefile, genefile))
+		}
 	}
 
+	tw.close()
+
+	logger.Printf("Wrote %d sequences to %s", nseq, geneoutfile)
 	logger.Printf("Done processing targets")
 }
 
+// writeManifest writes the manifest of a bundle, which is written
+// after the sequence and id files are closed, so that their checksums
+// can be computed.
+func writeManifest(rev bool, featureNames []string) {
+
+	m := &utils.TargetManifest{
+		FormatVersion: utils.TargetFormatVersion,
+		Created:       time.Now().UTC().Format(time.RFC3339),
+		CommandLine:   os.Args,
+		Sources:       sources,
+		NumSequences:  nseq,
+		TotalBases:    nbases,
+		Rev:           rev,
+		Mask:          mask,
+		Dedup:         dedup,
+		Features:      featureNames,
+		Qualifier:     qualifier,
+	}
+	finishManifest(m)
+}
+
+// finishManifest records the sizes and checksums of the sequence and
+// id files in the manifest, and writes it into the bundle.
+func finishManifest(m *utils.TargetManifest) {
+
+	prefix := outputPrefix(nil)
+	m.SeqFile = utils.NewBundleFile(prefix+".txt.sz", path.Base(prefix)+".txt.sz")
+	m.IdFile = utils.NewBundleFile(prefix+"_ids.txt.sz", path.Base(prefix)+"_ids.txt.sz")
+	m.Write(bundle)
+
+	logger.Printf("Wrote the bundle manifest to %s", path.Join(bundle, utils.TargetManifestName))
+}
+
 func setupLog() {
 	fid, err := os.Create("prep_targets.log")
 	if err != nil {
@@ -246,29 +481,90 @@ func setupLog() {
 func main() {
 
 	rev := flag.Bool("rev", false, "Include reverse complement sequences")
+	flag.StringVar(&mask, "mask", "hard", "Handling of lower case letters: 'upper', 'hard' or 'exclude-seeds'")
+	flag.StringVar(&out, "out", "", "Prefix of the output file names")
+	featureList := flag.String("features", "", "Comma-separated GenBank/EMBL feature types to extract, e.g. 'CDS,gene'")
+	flag.StringVar(&qualifier, "qualifier", "locus_tag", "Qualifier used to name extracted features")
+	flag.StringVar(&dedup, "dedup", "none", "Collapse duplicated sequences: 'none', 'exact' or 'revcomp'")
+	flag.StringVar(&bundle, "bundle", "", "Write the outputs and a manifest into this directory")
+	flag.BoolVar(&appending, "append", false, "Append the sequences to an existing bundle")
+	removeFile := flag.String("remove", "", "Remove the ids listed in this file from an existing bundle")
 	flag.Parse()
 	args := flag.Args()
 
-	if len(args) != 1 {
+	if len(args) == 0 && *removeFile == "" {
 		os.Stderr.WriteString("prep_targets: usage\n")
-		os.Stderr.WriteString("  prep_targets [-rev] genefile\n\n")
+		os.Stderr.WriteString("  prep_targets [-rev] [-mask=upper|hard|exclude-seeds] [-out=prefix] [-features=types] [-qualifier=name]\n")
+		os.Stderr.WriteString("    [-dedup=none|exact|revcomp] [-bundle=dir] genefile...\n")
+		os.Stderr.WriteString("  prep_targets -bundle=dir [-append] [-remove=idfile] [genefile...]\n\n")
+		os.Exit(1)
+	}
+	if (appending || *removeFile != "") && bundle == "" {
+		os.Stderr.WriteString("prep_targets: -append and -remove can only be used with -bundle\n")
+		os.Exit(1)
+	}
+	if appending && len(args) == 0 {
+		os.Stderr.WriteString("prep_targets: no files to append\n")
 		os.Exit(1)
 	}
 
-	genefile := args[0]
+	switch mask {
+	case "upper", "hard", "exclude-seeds":
+	default:
+		msg := fmt.Sprintf("prep_targets: -mask '%s' is not one of 'upper', 'hard' or 'exclude-seeds'\n", mask)
+		os.Stderr.WriteString(msg)
+		os.Exit(1)
+	}
 
-	gl := strings.ToLower(genefile)
-	if strings.HasSuffix(gl, "fasta") {
-		fasta = true
+	switch dedup {
+	case "none", "exact", "revcomp":
+	default:
+		msg := fmt.Sprintf("prep_targets: -dedup '%s' is not one of 'none', 'exact' or 'revcomp'\n", dedup)
+		os.Stderr.WriteString(msg)
+		os.Exit(1)
+	}
+
+	if bundle != "" {
+		if out != "" {
+			os.Stderr.WriteString("prep_targets: only one of -out and -bundle can be given\n")
+			os.Exit(1)
+		}
+		if err := os.MkdirAll(bundle, 0755); err != nil {
+			panic(err)
+		}
 	}
 
 	setupLog()
+
+	if appending || *removeFile != "" {
+		updateBundle(args, *removeFile)
+		logger.Printf("Done")
+		return
+	}
+
 	if *rev {
 		logger.Printf("Including reverse complements")
 	} else {
 		logger.Printf("Not including reverse complements")
 	}
+	logger.Printf("Lower case letters are handled using mode '%s'", mask)
+	logger.Printf("Duplicated sequences are handled using mode '%s'", dedup)
+
+	var featureNames []string
+	if *featureList != "" {
+		features = make(map[string]bool)
+		for _, f := range strings.Split(*featureList, ",") {
+			features[strings.TrimSpace(f)] = true
+			featureNames = append(featureNames, strings.TrimSpace(f))
+		}
+		logger.Printf("Extracting GenBank/EMBL features of type %s, named by /%s", *featureList, qualifier)
+	}
+
+	targets(args, *rev)
+
+	if bundle != "" {
+		writeManifest(*rev, featureNames)
+	}
 
-	targets(genefile, *rev)
 	logger.Printf("Done")
 }
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/kshedden/seqmatch/utils"
+)
+
+// readRemoveList returns the ids listed in a file, one per line.
+// Blank lines and lines starting with # are skipped.
+func readRemoveList(fname string) map[string]bool {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+
+	ids := make(map[string]bool)
+	scanner := bufio.NewScanner(fid)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ids[line] = true
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	return ids
+}
+
+// openBundleFile opens a snappy-compressed file of a bundle for
+// reading.
+func openBundleFile(fname string) (*os.File, *bufio.Scanner) {
+	fid, err := os.Open(fname)
+	if err != nil {
+		panic(err)
+	}
+	scanner := bufio.NewScanner(snappy.NewReader(fid))
+	scanner.Buffer(make([]byte, 4*maxline), 4*maxline)
+	return fid, scanner
+}
+
+// scanBundle calls fn for each row of the sequence file of the bundle,
+// with the fields of its id row, or nil for rows that have been
+// removed.
+func scanBundle(fn func(row int, seq string, idf []string)) {
+
+	prefix := outputPrefix(nil)
+	seqfile := prefix + ".txt.sz"
+	idfile := prefix + "_ids.txt.sz"
+
+	seqfid, seqin := openBundleFile(seqfile)
+	defer seqfid.Close()
+	idfid, idin := openBundleFile(idfile)
+	defer idfid.Close()
+
+	// The next id row, and its row number
+	var idf []string
+	idrow := -1
+	nextId := func() {
+		idrow = -1
+		if idin.Scan() {
+			idf = strings.Split(idin.Text(), "\t")
+			r, err := strconv.Atoi(idf[0])
+			if err != nil {
+				panic(err)
+			}
+			idrow = r
+		}
+	}
+	nextId()
+
+	for row := 0; seqin.Scan(); row++ {
+
+		// Rows without an id were removed earlier
+		if row != idrow {
+			fn(row, seqin.Text(), nil)
+			continue
+		}
+
+		fn(row, seqin.Text(), idf)
+		nextId()
+	}
+	if err := seqin.Err(); err != nil {
+		panic(err)
+	}
+	if err := idin.Err(); err != nil {
+		panic(err)
+	}
+	if idrow != -1 {
+		panic(fmt.Sprintf("%s has more rows than %s", idfile, seqfile))
+	}
+}
+
+// removeTargets removes the targets with the given ids from the
+// bundle.  The sequence of a removed row is replaced with an empty
+// line and its id row is dropped, so that the other rows keep their
+// numbers.  The reverse complement rows of removed targets (with _r
+// appended to their ids) are also removed.  For rows that collapse
+// several ids (see -dedup), the removed ids are dropped from the list,
+// and the row is removed when no ids are left.  Ids are compared to
+// the first word of the target names, so that FASTA descriptions are
+// ignored.  Listed ids that do not match any target are logged.  It
+// returns the number of rows removed and the number of bases in them.
+func removeTargets(m *utils.TargetManifest, remove map[string]bool) (int, int64) {
+
+	// An id is removed if its first word is listed, ignoring the '>'
+	// of FASTA ids and the _r of reverse complements (which follows
+	// any description).
+	stripR := m.Rev || m.Dedup == "revcomp"
+	matched := make(map[string]bool)
+	firstWord := func(name string) string {
+		if f := strings.Fields(name); len(f) > 0 {
+			return f[0]
+		}
+		return name
+	}
+	removed := func(name string) bool {
+		name = strings.TrimPrefix(name, ">")
+		if id := firstWord(name); remove[id] {
+			matched[id] = true
+			return true
+		}
+		if stripR && strings.HasSuffix(name, "_r") {
+			if id := firstWord(strings.TrimSuffix(name, "_r")); remove[id] {
+				matched[id] = true
+				return true
+			}
+		}
+		return false
+	}
+
+	prefix := outputPrefix(nil)
+	seqfile := prefix + ".txt.sz"
+	idfile := prefix + "_ids.txt.sz"
+
+	create := func(fname string) (*os.File, *snappy.Writer) {
+		fid, err := os.Create(fname)
+		if err != nil {
+			panic(err)
+		}
+		return fid, snappy.NewBufferedWriter(fid)
+	}
+	seqtmp, seqout := create(seqfile + ".tmp")
+	idtmp, idout := create(idfile + ".tmp")
+
+	var nrow int
+	var nbases int64
+	scanBundle(func(row int, seq string, idf []string) {
+
+		if idf == nil {
+			if _, err := seqout.Write([]byte(seq + "\n")); err != nil {
+				panic(err)
+			}
+			return
+		}
+
+		names := strings.Split(idf[1], ";")
+		srcs := strings.Split(idf[3], ";")
+		var metas []string
+		if len(idf) > 4 && idf[4] != "-" {
+			metas = strings.Split(idf[4], "|")
+		}
+
+		// The ids that are kept
+		var keep, keepsrc, keepmeta []string
+		for i, name := range names {
+			if removed(name) {
+				continue
+			}
+			keep = append(keep, name)
+			if len(srcs) == len(names) {
+				keepsrc = append(keepsrc, srcs[i])
+			}
+			if len(metas) == len(names) {
+				keepmeta = append(keepmeta, metas[i])
+			}
+		}
+
+		switch {
+		case len(keep) == 0:
+			nrow++
+			nbases += int64(len(seq))
+			seq = ""
+		case len(keep) < len(names):
+			idf[1] = strings.Join(keep, ";")
+			if len(keepsrc) > 0 {
+				idf[3] = strings.Join(keepsrc, ";")
+			}
+			if len(keepmeta) > 0 {
+				idf[4] = joinMeta(keepmeta)
+			}
+		}
+
+		if _, err := seqout.Write([]byte(seq + "\n")); err != nil {
+			panic(err)
+		}
+		if len(keep) > 0 {
+			if _, err := idout.Write([]byte(strings.Join(idf, "\t") + "\n")); err != nil {
+				panic(err)
+			}
+		}
+	})
+
+	var unmatched []string
+	for id := range remove {
+		if !matched[id] {
+			unmatched = append(unmatched, id)
+		}
+	}
+	if len(unmatched) > 0 {
+		sort.Strings(unmatched)
+		for _, id := range unmatched {
+			logger.Printf("No target has id %s", id)
+		}
+	}
+
+	for _, c := range []interface{ Close() error }{seqout, idout, seqtmp, idtmp} {
+		if err := c.Close(); err != nil {
+			panic(err)
+		}
+	}
+	if err := os.Rename(seqfile+".tmp", seqfile); err != nil {
+		panic(err)
+	}
+	if err := os.Rename(idfile+".tmp", idfile); err != nil {
+		panic(err)
+	}
+
+	return nrow, nbases
+}
+
+// seedDeduper adds the targets of the bundle to dd, so that appended
+// sequences that duplicate them are merged into their rows.  When
+// reverse complements are included, each target is followed by its
+// reverse complement row, whose ids are passed along with the target.
+func seedDeduper(dd *deduper, rev bool) {
+
+	meta := func(idf []string) string {
+		if len(idf) > 4 {
+			return idf[4]
+		}
+		return "-"
+	}
+
+	var fseq string
+	var fidf []string
+	scanBundle(func(row int, seq string, idf []string) {
+		switch {
+		case idf == nil:
+			return
+		case !rev:
+			dd.seed(row, seq, idf[1], "-", idf[3], meta(idf))
+		case row%2 == 0:
+			fseq, fidf = seq, idf
+		default:
+			dd.seed(row-1, fseq, fidf[1], idf[1], fidf[3], meta(fidf))
+		}
+	})
+}
+
+// mergeIds replaces the id rows of the existing targets that appended
+// sequences were merged into (see deduper.finish).
+func mergeIds() {
+
+	idfile := outputPrefix(nil) + "_ids.txt.sz"
+	idfid, idin := openBundleFile(idfile)
+	defer idfid.Close()
+
+	fid, err := os.Create(idfile + ".tmp")
+	if err != nil {
+		panic(err)
+	}
+	idout := snappy.NewBufferedWriter(fid)
+
+	for idin.Scan() {
+		line := idin.Text()
+		f := strings.SplitN(line, "\t", 2)
+		row, err := strconv.Atoi(f[0])
+		if err != nil {
+			panic(err)
+		}
+		if x, ok := merged[row]; ok {
+			line = fmt.Sprintf("%011d\t%s", row, x)
+		}
+		if _, err := idout.Write([]byte(line + "\n")); err != nil {
+			panic(err)
+		}
+	}
+	if err := idin.Err(); err != nil {
+		panic(err)
+	}
+
+	if err := idout.Close(); err != nil {
+		panic(err)
+	}
+	if err := fid.Close(); err != nil {
+		panic(err)
+	}
+	if err := os.Rename(idfile+".tmp", idfile); err != nil {
+		panic(err)
+	}
+}
+
+// updateBundle removes targets from and/or appends the targets in
+// args to an existing bundle.  The appended targets are numbered after
+// the existing rows, and are prepared using the options recorded in
+// the manifest.  If the bundle was deduplicated, appended sequences
+// that duplicate existing targets are added to their ids.
+func updateBundle(args []string, removeFile string) {
+
+	m, err := utils.ReadTargetManifest(bundle)
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("prep_targets: %v\n", err))
+		os.Exit(1)
+	}
+	if err := m.Validate(bundle); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("prep_targets: %v\n", err))
+		os.Exit(1)
+	}
+
+	update := utils.TargetUpdate{
+		Time:        time.Now().UTC().Format(time.RFC3339),
+		CommandLine: os.Args,
+	}
+
+	if removeFile != "" {
+		nrow, nb := removeTargets(m, readRemoveList(removeFile))
+		m.NumRemoved += nrow
+		m.TotalBases -= nb
+		update.Removed = nrow
+		logger.Printf("Removed %d rows from %s", nrow, bundle)
+	}
+
+	if appending {
+		mask = m.Mask
+		dedup = m.Dedup
+		qualifier = m.Qualifier
+		features = nil
+		if len(m.Features) > 0 {
+			features = make(map[string]bool)
+			for _, f := range m.Features {
+				features[f] = true
+			}
+		}
+		logger.Printf("Appending to %s using the options in its manifest", bundle)
+
+		nseq = m.NumSequences
+		nbases = m.TotalBases
+		targets(args, m.Rev)
+		if len(merged) > 0 {
+			mergeIds()
+		}
+
+		update.Appended = nseq - m.NumSequences
+		m.NumSequences = nseq
+		m.TotalBases = nbases
+		m.Sources = append(m.Sources, sources...)
+	}
+
+	m.FormatVersion = utils.TargetFormatVersion
+	m.Updates = append(m.Updates, update)
+	finishManifest(m)
+}
@@ -19,6 +19,8 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -26,7 +28,6 @@ import (
 	"github.com/golang/snappy"
 	"github.com/kshedden/seqmatch/utils"
 	"github.com/scipipe/scipipe"
-	"github.com/willf/bloom"
 	"golang.org/x/sys/unix"
 )
 
@@ -73,6 +74,67 @@ func pipefromsz(fname string) string {
 	panic("unable to create pipe")
 }
 
+// readTally accumulates the UMIs and samples of the reads that share
+// a sequence.
+type readTally struct {
+
+	// The distinct non-blank UMIs
+	umis map[string]bool
+
+	// The number of reads from each sample
+	samples map[string]int
+
+	// The number of reads from each read file, and the labels of
+	// the read files
+	files  map[string]int
+	labels []string
+}
+
+func (rt *readTally) reset() {
+	rt.umis = make(map[string]bool)
+	rt.samples = make(map[string]int)
+	rt.files = make(map[string]int)
+}
+
+// add includes one read, given as the fields of a line produced by
+// prep_reads, in the tally.
+func (rt *readTally) add(fields []string) {
+	if umi := fields[2]; umi != "" {
+		rt.umis[umi] = true
+	}
+	if sample := fields[3]; sample != "" {
+		rt.samples[sample]++
+	}
+	i, err := strconv.Atoi(fields[4])
+	if err != nil {
+		panic(err)
+	}
+	rt.files[rt.labels[i]]++
+}
+
+// formatCounts returns the counts as a list of key:count pairs,
+// sorted by key and separated by commas, or "-" if there are no
+// counts.
+func formatCounts(counts map[string]int) string {
+
+	if len(counts) == 0 {
+		return "-"
+	}
+
+	var keys []string
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var x []string
+	for _, k := range keys {
+		x = append(x, fmt.Sprintf("%s:%d", k, counts[k]))
+	}
+
+	return strings.Join(x, ",")
+}
+
 func sortSource() {
 
 	logger.Printf("starting sortSource")
@@ -82,6 +144,9 @@ func sortSource() {
 	cmd0.Env = os.Environ()
 	cmd0.Stderr = os.Stderr
 
+	// Reads may be piped into runmatch (ReadFileName "-").
+	cmd0.Stdin = os.Stdin
+
 	cmd1 := exec.Command("sort", "-S", "2G", "--parallel=8")
 	cmd1.Env = os.Environ()
 	cmd1.Stderr = os.Stderr
@@ -127,12 +192,20 @@ func sortSource() {
 	if err := scanner.Err(); err != nil {
 		panic(err)
 	}
-	fields := strings.Fields(scanner.Text())
+	fields := strings.Split(scanner.Text(), "\t")
 	seq := fields[0]
 	name := []string{fields[1]}
 	n := 1
 	nseq := 0
 
+	files, _ := config.ReadFiles()
+	tally := readTally{labels: utils.ReadFileLabels(files)}
+	tally.reset()
+	for i, f := range files {
+		logger.Printf("Read file %s is labeled %s", f, tally.labels[i])
+	}
+	tally.add(fields)
+
 	dowrite := func(seq string, name []string, n int) {
 		xn := strings.Join(name, ";")
 		if len(xn) > 1000 {
@@ -148,7 +221,8 @@ func sortSource() {
 		if err != nil {
 			panic(err)
 		}
-		s := fmt.Sprintf("%d\t%s\n", n, xn)
+		s := fmt.Sprintf("%d\t%s\t%d\t%s\t%s\n", n, xn, len(tally.umis),
+			formatCounts(tally.samples), formatCounts(tally.files))
 		_, err = wtr.Write([]byte(s))
 		if err != nil {
 			panic(err)
@@ -157,13 +231,14 @@ func sortSource() {
 
 	for scanner.Scan() {
 		line := scanner.Text()
-		fields1 := strings.Fields(line)
+		fields1 := strings.Split(line, "\t")
 		seq1 := fields1[0]
 		name1 := fields1[1]
 
 		if strings.Compare(seq, seq1) == 0 {
 			n++
 			name = append(name, name1)
+			tally.add(fields1)
 			continue
 		}
 
@@ -172,6 +247,8 @@ func sortSource() {
 		name = name[0:1]
 		name[0] = name1
 		n = 1
+		tally.reset()
+		tally.add(fields1)
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -544,24 +621,22 @@ func joinGeneNames() {
 	gn := scipipe.NewProc("gn", fmt.Sprintf("sztool -d %s > {os:gn}", config.GeneIdFileName))
 	gn.SetPathStatic("gn", path.Join(pipedir, "jgn_gn.txt"))
 
-	// Join genes and matches
-	jo := scipipe.NewProc("jo", "join -1 5 -2 1 -t'\t' {i:mx} {i:gx} > {os:jx}")
+	// Join genes and matches.  The output columns are the read,
+	// the matching target subsequence, the position, the number
+	// of mismatches, the target name, the target length and the
+	// strand.
+	jo := scipipe.NewProc("jo", "join -1 5 -2 1 -t'\t' -o 1.1,1.2,1.3,1.4,2.2,2.3,1.6 {i:mx} {i:gx} > {os:jx}")
 	jo.SetPathStatic("jx", path.Join(pipedir, "jgn_joined.txt"))
 
-	// Cut out unwanted column
-	ct := scipipe.NewProc("ct", "cut -d'\t' -f 1 --complement {i:jy} > {os:co}")
-	ct.SetPathStatic("co", path.Join(pipedir, "jgn_cut.txt"))
-
 	// Compress the result
 	sz := scipipe.NewProc("sz", fmt.Sprintf("sztool -c {i:zi} %s", path.Join(tmpdir, "matches_sn.txt.sz")))
 
 	jo.In("mx").Connect(ma.Out("ma"))
 	jo.In("gx").Connect(gn.Out("gn"))
-	ct.In("jy").Connect(jo.Out("jx"))
-	sz.In("zi").Connect(ct.Out("co"))
+	sz.In("zi").Connect(jo.Out("jx"))
 
 	wf := scipipe.NewWorkflow("jgn")
-	wf.AddProcs(ma, gn, jo, ct, sz)
+	wf.AddProcs(ma, gn, jo, sz)
 	wf.SetDriver(sz)
 	wf.Run()
 
@@ -600,8 +675,12 @@ func joinReadNames() {
 	sm := scipipe.NewProc("sm", "sort -S 2G --parallel=8 -k1 {i:in} > {os:sort}")
 	sm.SetPathStatic("sort", path.Join(pipedir, "jrn_sort.txt"))
 
-	// Join the sorted matches with the reads
-	jo := scipipe.NewProc("jo", "join -1 1 -2 1 -t'\t' {i:srx} {i:rdx} > {o:out}")
+	// Join the sorted matches with the reads.  The read count and
+	// read names are placed before the strand, so that the
+	// columns added later are at the end of each line.  The
+	// number of distinct UMIs, the sample counts and the read
+	// file counts follow the strand.
+	jo := scipipe.NewProc("jo", "join -1 1 -2 1 -t'\t' -o 1.1,1.2,1.3,1.4,1.5,1.6,2.2,2.3,1.7,2.4,2.5,2.6 {i:srx} {i:rdx} > {o:out}")
 	jo.SetPathStatic("out", config.ResultsFileName)
 
 	snk := scipipe.NewSink("snk")
@@ -648,6 +727,13 @@ func handleArgs() {
 
 	ConfigFileName := flag.String("ConfigFileName", "", "JSON file containing configuration parameters")
 	ReadFileName := flag.String("ReadFileName", "", "Sequencing read file (fastq format)")
+	ReadFileName2 := flag.String("ReadFileName2", "", "Second mates of paired-end reads")
+	ReadFileNamesRaw := flag.String("ReadFileNames", "", "Comma-separated additional read files or glob patterns")
+	ReadFileNames2Raw := flag.String("ReadFileNames2", "", "Comma-separated second mate files for ReadFileNames")
+	ReadManifest := flag.String("ReadManifest", "", "File listing read files, one per line")
+	ReadFormat := flag.String("ReadFormat", "", "Read file format: 'fastq', 'fasta', 'tab', 'sam' or 'bam' (detected if blank)")
+	ReadValidation := flag.String("ReadValidation", "", "'strict' (stop at malformed fastq records) or 'lenient' (skip them)")
+	InterleavedPairs := flag.Bool("InterleavedPairs", false, "SAM or BAM read files contain the two mates of each pair in consecutive records")
 	GeneFileName := flag.String("GeneFileName", "", "Gene file name (processed form)")
 	GeneIdFileName := flag.String("GeneIdFileName", "", "Gene ID file name (processed form)")
 	ResultsFileName := flag.String("ResultsFileName", "", "File name for results")
@@ -656,14 +742,45 @@ func handleArgs() {
 	BloomSize := flag.Int("BloomSize", 0, "Size of Bloom filter, in bits")
 	NumHash := flag.Int("NumHash", 0, "Number of hashses")
 	PMatch := flag.Float64("PMatch", 0, "Required proportion of matching positions")
+	SearchStrand := flag.String("SearchStrand", "", "Read strands to search: 'forward', 'reverse' or 'both'")
 	MinDinuc := flag.Int("MinDinuc", 0, "Minimum number of dinucleotides to check for match")
+	MaxDust := flag.Float64("MaxDust", 0, "Skip windows with DUST score above this value")
+	MinEntropy := flag.Float64("MinEntropy", 0, "Skip windows with k-mer entropy (bits) below this value")
+	EntropyK := flag.Int("EntropyK", 0, "K-mer length for the entropy filter (defaults to 2)")
+	MaxHomopolymer := flag.Int("MaxHomopolymer", 0, "Skip windows with a homopolymer run longer than this")
 	TempDir := flag.String("TempDir", "", "Workspace for temporary files")
 	MinReadLength := flag.Int("MinReadLength", 0, "Reads shorter than this length are skipped")
 	MaxReadLength := flag.Int("MaxReadLength", 0, "Reads longer than this length are truncated")
+	AdaptersRaw := flag.String("Adapters", "", "Comma-separated 3' adapter sequences to trim from reads")
+	PrimersRaw := flag.String("Primers", "", "Comma-separated 5' primer sequences to trim from reads")
+	AdapterMismatches := flag.Int("AdapterMismatches", 0, "Mismatches allowed when matching an adapter or primer")
+	AdapterMinOverlap := flag.Int("AdapterMinOverlap", 0, "Minimum overlap of an adapter or primer with a read")
+	TrimPolyA := flag.Bool("TrimPolyA", false, "Trim poly-A tails from the 3' end of reads")
+	TrimPolyT := flag.Bool("TrimPolyT", false, "Trim poly-T heads from the 5' end of reads")
+	TrimHomopolymer := flag.Bool("TrimHomopolymer", false, "Trim homopolymer tails from the 3' end of reads")
+	TailMinLength := flag.Int("TailMinLength", 0, "Minimum length of a trimmed poly-A, poly-T or homopolymer run")
+	TailMismatches := flag.Int("TailMismatches", 0, "Other letters allowed within a poly-A, poly-T or homopolymer run")
+	QualityOffset := flag.Int("QualityOffset", 0, "Offset of fastq quality scores (defaults to 33)")
+	TrimQuality := flag.Int("TrimQuality", 0, "Trim 3' read ends with mean quality below this value")
+	TrimWindow := flag.Int("TrimWindow", 0, "Width of window for quality trimming")
+	MaskQuality := flag.Int("MaskQuality", 0, "Replace bases with quality below this value with X")
+	MaxReads := flag.Int("MaxReads", 0, "Use only the first MaxReads reads")
+	SampleFraction := flag.Float64("SampleFraction", 0, "Use a random fraction of the reads")
+	SampleCount := flag.Int("SampleCount", 0, "Use a random sample of this many reads")
+	SampleSeed := flag.Int64("SampleSeed", 0, "Seed for random sampling of reads")
+	AnnotationFileName := flag.String("AnnotationFileName", "", "GFF3 or GTF file of features on the targets")
+	AnnotationTypesRaw := flag.String("AnnotationTypes", "", "Comma-separated feature types used to annotate matches")
+	BarcodeFileName := flag.String("BarcodeFileName", "", "File of sample barcodes (barcode and sample name on each line)")
+	BarcodeMismatches := flag.Int("BarcodeMismatches", 0, "Mismatches allowed when matching a sample barcode")
+	UMIPattern := flag.String("UMIPattern", "", "Regular expression extracting the UMI from read names")
+	UMIStart := flag.Int("UMIStart", 0, "Position of the UMI in each read")
+	UMILength := flag.Int("UMILength", 0, "Length of the UMI in each read")
 	MaxMatches := flag.Int("MaxMatches", 0, "Return no more than this number of matches per window")
 	MaxMergeProcs := flag.Int("MaxMergeProcs", 0, "Run this number of merge processes concurrently")
 	MMTol := flag.Int("MMTol", 0, "Number of mismatches allowed above best fit")
 	StartPoint := flag.Int("StartPoint", 0, "Restart at a given point in the procedure")
+	MinInsertSize := flag.Int("MinInsertSize", 0, "Smallest insert size for a concordant read pair")
+	MaxInsertSize := flag.Int("MaxInsertSize", 0, "Largest insert size for a concordant read pair")
 	MatchMode := flag.String("MatchMode", "", "'first' (retain first matches meeting criteria) or 'best' (returns best matches meeting criteria)")
 
 	flag.Parse()
@@ -678,6 +795,24 @@ func handleArgs() {
 	if *ReadFileName != "" {
 		config.ReadFileName = *ReadFileName
 	}
+	if *ReadFileName2 != "" {
+		config.ReadFileName2 = *ReadFileName2
+	}
+	if *ReadFileNamesRaw != "" {
+		config.ReadFileNames = strings.Split(*ReadFileNamesRaw, ",")
+	}
+	if *ReadFileNames2Raw != "" {
+		config.ReadFileNames2 = strings.Split(*ReadFileNames2Raw, ",")
+	}
+	if *ReadManifest != "" {
+		config.ReadManifest = *ReadManifest
+	}
+	if *ReadFormat != "" {
+		config.ReadFormat = *ReadFormat
+	}
+	if *ReadValidation != "" {
+		config.ReadValidation = *ReadValidation
+	}
 	if *GeneFileName != "" {
 		config.GeneFileName = *GeneFileName
 	}
@@ -696,9 +831,24 @@ func handleArgs() {
 	if *PMatch != 0 {
 		config.PMatch = *PMatch
 	}
+	if *SearchStrand != "" {
+		config.SearchStrand = *SearchStrand
+	}
 	if *MinDinuc != 0 {
 		config.MinDinuc = *MinDinuc
 	}
+	if *MaxDust != 0 {
+		config.MaxDust = *MaxDust
+	}
+	if *MinEntropy != 0 {
+		config.MinEntropy = *MinEntropy
+	}
+	if *EntropyK != 0 {
+		config.EntropyK = *EntropyK
+	}
+	if *MaxHomopolymer != 0 {
+		config.MaxHomopolymer = *MaxHomopolymer
+	}
 	if *TempDir != "" {
 		config.TempDir = *TempDir
 	}
@@ -708,6 +858,81 @@ func handleArgs() {
 	if *MaxReadLength != 0 {
 		config.MaxReadLength = *MaxReadLength
 	}
+	if *AdaptersRaw != "" {
+		config.Adapters = strings.Split(*AdaptersRaw, ",")
+	}
+	if *PrimersRaw != "" {
+		config.Primers = strings.Split(*PrimersRaw, ",")
+	}
+	if *AdapterMismatches != 0 {
+		config.AdapterMismatches = *AdapterMismatches
+	}
+	if *AdapterMinOverlap != 0 {
+		config.AdapterMinOverlap = *AdapterMinOverlap
+	}
+	if *InterleavedPairs {
+		config.InterleavedPairs = true
+	}
+	if *TrimPolyA {
+		config.TrimPolyA = true
+	}
+	if *TrimPolyT {
+		config.TrimPolyT = true
+	}
+	if *TrimHomopolymer {
+		config.TrimHomopolymer = true
+	}
+	if *TailMinLength != 0 {
+		config.TailMinLength = *TailMinLength
+	}
+	if *TailMismatches != 0 {
+		config.TailMismatches = *TailMismatches
+	}
+	if *QualityOffset != 0 {
+		config.QualityOffset = *QualityOffset
+	}
+	if *TrimQuality != 0 {
+		config.TrimQuality = *TrimQuality
+	}
+	if *TrimWindow != 0 {
+		config.TrimWindow = *TrimWindow
+	}
+	if *MaskQuality != 0 {
+		config.MaskQuality = *MaskQuality
+	}
+	if *MaxReads != 0 {
+		config.MaxReads = *MaxReads
+	}
+	if *SampleFraction != 0 {
+		config.SampleFraction = *SampleFraction
+	}
+	if *SampleCount != 0 {
+		config.SampleCount = *SampleCount
+	}
+	if *SampleSeed != 0 {
+		config.SampleSeed = *SampleSeed
+	}
+	if *AnnotationFileName != "" {
+		config.AnnotationFileName = *AnnotationFileName
+	}
+	if *AnnotationTypesRaw != "" {
+		config.AnnotationTypes = strings.Split(*AnnotationTypesRaw, ",")
+	}
+	if *BarcodeFileName != "" {
+		config.BarcodeFileName = *BarcodeFileName
+	}
+	if *BarcodeMismatches != 0 {
+		config.BarcodeMismatches = *BarcodeMismatches
+	}
+	if *UMIPattern != "" {
+		config.UMIPattern = *UMIPattern
+	}
+	if *UMIStart != 0 {
+		config.UMIStart = *UMIStart
+	}
+	if *UMILength != 0 {
+		config.UMILength = *UMILength
+	}
 	if *MaxMatches != 0 {
 		config.MaxMatches = *MaxMatches
 	}
@@ -723,6 +948,12 @@ func handleArgs() {
 	if *ResultsFileName != "" {
 		config.ResultsFileName = *ResultsFileName
 	}
+	if *MinInsertSize != 0 {
+		config.MinInsertSize = *MinInsertSize
+	}
+	if *MaxInsertSize != 0 {
+		config.MaxInsertSize = *MaxInsertSize
+	}
 
 	if config.ResultsFileName == "" {
 		print("ResultsFileName must be specified")
@@ -745,9 +976,56 @@ func handleArgs() {
 	}
 }
 
+// checkTargetBundle checks the target files against the manifest of
+// the bundle that they belong to.  GeneFileName may name a bundle
+// directory, in which case the file names are taken from its
+// manifest.  Otherwise, if there is a manifest in the directory
+// containing GeneFileName, both target files must be the ones that it
+// describes.  Target files without a manifest are not checked.
+func checkTargetBundle() {
+
+	fail := func(err error) {
+		msg := fmt.Sprintf("Invalid target bundle: %v\n", err)
+		os.Stderr.WriteString(msg)
+		os.Exit(1)
+	}
+
+	dir := path.Dir(config.GeneFileName)
+	if fi, err := os.Stat(config.GeneFileName); err == nil && fi.IsDir() {
+		dir = path.Clean(config.GeneFileName)
+		m, err := utils.ReadTargetManifest(dir)
+		if err != nil {
+			fail(err)
+		}
+		config.GeneFileName = path.Join(dir, m.SeqFile.Name)
+		if config.GeneIdFileName == "" {
+			config.GeneIdFileName = path.Join(dir, m.IdFile.Name)
+		}
+	}
+
+	m, err := utils.ReadTargetManifest(dir)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		fail(err)
+	}
+
+	if path.Base(config.GeneFileName) != m.SeqFile.Name || path.Dir(config.GeneFileName) != dir {
+		fail(fmt.Errorf("GeneFileName %s is not the sequence file %s of the bundle in %s",
+			config.GeneFileName, m.SeqFile.Name, dir))
+	}
+	if path.Base(config.GeneIdFileName) != m.IdFile.Name || path.Dir(config.GeneIdFileName) != dir {
+		fail(fmt.Errorf("GeneIdFileName %s is not the id file %s of the bundle in %s",
+			config.GeneIdFileName, m.IdFile.Name, dir))
+	}
+	if err := m.Validate(dir); err != nil {
+		fail(err)
+	}
+}
+
 func checkArgs() {
 
-	if config.ReadFileName == "" {
+	if config.ReadFileName == "" && len(config.ReadFileNames) == 0 && config.ReadManifest == "" {
 		os.Stderr.WriteString("ReadFileName not provided\n")
 		os.Exit(1)
 	}
@@ -755,6 +1033,7 @@ func checkArgs() {
 		os.Stderr.WriteString("GeneFileName not provided\n")
 		os.Exit(1)
 	}
+	checkTargetBundle()
 	if config.GeneIdFileName == "" {
 		os.Stderr.WriteString("GeneIdFileName not provided\n")
 		os.Exit(1)
@@ -791,15 +1070,140 @@ func checkArgs() {
 		os.Stderr.WriteString("MaxMergeProcs not provided, defaulting to 3\n")
 		config.MaxMergeProcs = 3
 	}
-	if !strings.HasSuffix(config.ReadFileName, ".fastq") {
-		msg := fmt.Sprintf("Warning: %s may not be a fastq file, continuing anyway\n",
-			config.ReadFileName)
+	switch config.ReadFormat {
+	case "", "fastq", "fasta", "tab", "sam", "bam":
+	default:
+		msg := fmt.Sprintf("ReadFormat '%s' is not one of 'fastq', 'fasta', 'tab', 'sam' or 'bam'\n", config.ReadFormat)
 		os.Stderr.WriteString(msg)
+		os.Exit(1)
+	}
+	switch config.SearchStrand {
+	case "":
+		config.SearchStrand = "forward"
+	case "forward", "reverse", "both":
+	default:
+		msg := fmt.Sprintf("SearchStrand '%s' is not one of 'forward', 'reverse' or 'both'\n", config.SearchStrand)
+		os.Stderr.WriteString(msg)
+		os.Exit(1)
+	}
+	switch config.ReadValidation {
+	case "":
+		config.ReadValidation = "strict"
+	case "strict", "lenient":
+	default:
+		msg := fmt.Sprintf("ReadValidation '%s' is not one of 'strict' or 'lenient'\n", config.ReadValidation)
+		os.Stderr.WriteString(msg)
+		os.Exit(1)
+	}
+	// Reads from standard input or a named pipe can only be read
+	// once, and there is no directory in which to place the
+	// temporary files.
+	var nstdin int
+	var streamed bool
+	files1, files2 := config.ReadFiles()
+	for _, fname := range append(files1, files2...) {
+		if utils.IsStdin(fname) {
+			nstdin++
+			streamed = true
+			continue
+		}
+		fi, err := os.Stat(fname)
+		if err != nil {
+			msg := fmt.Sprintf("Cannot access read file: %v\n", err)
+			os.Stderr.WriteString(msg)
+			os.Exit(1)
+		}
+		if fi.Mode()&os.ModeNamedPipe != 0 {
+			streamed = true
+			continue
+		}
+
+		// Compressed files are decoded transparently, so only
+		// look at the suffix that remains after removing the
+		// compression suffix.
+		rfn := fname
+		for _, ext := range []string{".gz", ".bz2", ".zst"} {
+			rfn = strings.TrimSuffix(rfn, ext)
+		}
+		if config.ReadFormat == "fastq" && !(strings.HasSuffix(rfn, ".fastq") || strings.HasSuffix(rfn, ".fq")) {
+			msg := fmt.Sprintf("Warning: %s may not be a fastq file, continuing anyway\n", fname)
+			os.Stderr.WriteString(msg)
+		}
 	}
 	if config.MatchMode == "" {
 		os.Stderr.WriteString("MatchMode not provided, defaulting to 'first'\n")
 		config.MatchMode = "first"
 	}
+	if config.EntropyK < 0 || config.EntropyK > 8 {
+		os.Stderr.WriteString("EntropyK must be between 1 and 8, or 0 for the default of 2\n")
+		os.Exit(1)
+	}
+	if config.SampleFraction < 0 || config.SampleFraction > 1 {
+		os.Stderr.WriteString("SampleFraction must be between 0 and 1\n")
+		os.Exit(1)
+	}
+	if config.SampleFraction > 0 && config.SampleCount > 0 {
+		os.Stderr.WriteString("Only one of SampleFraction and SampleCount may be provided\n")
+		os.Exit(1)
+	}
+	if (config.SampleFraction > 0 || config.SampleCount > 0) && config.SampleSeed == 0 {
+		// The seed is saved with the copied configuration, so
+		// that the sample can be reproduced.
+		config.SampleSeed = time.Now().UnixNano()
+		msg := fmt.Sprintf("SampleSeed not provided, using %d\n", config.SampleSeed)
+		os.Stderr.WriteString(msg)
+	}
+	if config.AnnotationFileName != "" {
+		if _, err := os.Stat(config.AnnotationFileName); err != nil {
+			msg := fmt.Sprintf("Cannot read AnnotationFileName: %v\n", err)
+			os.Stderr.WriteString(msg)
+			os.Exit(1)
+		}
+	}
+	if config.BarcodeFileName != "" {
+		if _, err := os.Stat(config.BarcodeFileName); err != nil {
+			msg := fmt.Sprintf("Cannot read BarcodeFileName: %v\n", err)
+			os.Stderr.WriteString(msg)
+			os.Exit(1)
+		}
+	}
+	if config.UMIPattern != "" {
+		if _, err := regexp.Compile(config.UMIPattern); err != nil {
+			msg := fmt.Sprintf("UMIPattern '%s' is not a valid regular expression: %v\n", config.UMIPattern, err)
+			os.Stderr.WriteString(msg)
+			os.Exit(1)
+		}
+		if config.UMILength > 0 {
+			os.Stderr.WriteString("Only one of UMIPattern and UMILength may be provided\n")
+			os.Exit(1)
+		}
+	}
+	if nstdin > 1 {
+		os.Stderr.WriteString("Standard input ('-') can only be used for one read file\n")
+		os.Exit(1)
+	}
+	if streamed && config.TempDir == "" {
+		os.Stderr.WriteString("TempDir must be provided when reading from standard input or a named pipe\n")
+		os.Exit(1)
+	}
+	if config.InterleavedPairs && len(files2) > 0 {
+		os.Stderr.WriteString("InterleavedPairs cannot be used with files of second mates\n")
+		os.Exit(1)
+	}
+	// Mates interleaved in a SAM or BAM file are detected from the
+	// first record, which cannot be read twice from a stream.
+	if !config.InterleavedPairs && len(files2) == 0 && len(files1) > 0 && !streamed {
+		ris := utils.NewReadInSeq(files1[0], "", config.ReadFormat)
+		if (ris.Format == "sam" || ris.Format == "bam") && ris.Next() && ris.Mate != 0 {
+			os.Stderr.WriteString("Reads are interleaved pairs, setting InterleavedPairs\n")
+			config.InterleavedPairs = true
+		}
+		ris.Close()
+	}
+	if config.Paired() && config.MaxInsertSize == 0 {
+		os.Stderr.WriteString("MaxInsertSize not provided, defaulting to 1000\n")
+		config.MaxInsertSize = 1000
+	}
 }
 
 func setupEnvs() {
@@ -823,7 +1227,8 @@ func setupEnvs() {
 func makeTemp() {
 	var d string
 	var err error
-	d, basename = path.Split(config.ReadFileName)
+	files, _ := config.ReadFiles()
+	d, basename = path.Split(files[0])
 	if config.TempDir == "" {
 		d = path.Join(d, "tmp")
 		err = os.MkdirAll(d, 0755)
@@ -849,85 +1254,504 @@ func makeTemp() {
 	}
 }
 
-func writeNonMatch() {
+// mateHit is a match of one mate of a read pair into a target.
+type mateHit struct {
+	pos    int
+	length int
+	nmiss  string
+	strand string
+}
 
-	logger.Print("Starting writeNonMatch")
+// writePairs writes the pair and singleton records for one read pair
+// and one target.
+func writePairs(wtr io.Writer, base, gene string, hits [2][]mateHit) {
+
+	paired := [2][]bool{make([]bool, len(hits[0])), make([]bool, len(hits[1]))}
+
+	for i, h1 := range hits[0] {
+		for j, h2 := range hits[1] {
+			if h1.strand != h2.strand {
+				continue
+			}
+
+			// On the forward strand, the first mate must be
+			// upstream of the second mate (which was reverse
+			// complemented in prep_reads).  On the reverse
+			// strand the order is reversed.
+			up, down := h1, h2
+			if h1.strand == "-" {
+				up, down = h2, h1
+			}
+			insert := down.pos + down.length - up.pos
+			if up.pos > down.pos || insert < config.MinInsertSize || insert > config.MaxInsertSize {
+				continue
+			}
+			paired[0][i] = true
+			paired[1][j] = true
+			_, err := fmt.Fprintf(wtr, "%s\t%s\t%d\t%d\t%d\t%s\t%s\tpair\t%s\n",
+				base, gene, h1.pos, h2.pos, insert, h1.nmiss, h2.nmiss, h1.strand)
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	// Singleton hits, where the other mate has no concordant hit
+	// into this target.
+	for i, h := range hits[0] {
+		if !paired[0][i] {
+			_, err := fmt.Fprintf(wtr, "%s\t%s\t%d\t-\t-\t%s\t-\tmate1\t%s\n", base, gene, h.pos, h.nmiss, h.strand)
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+	for j, h := range hits[1] {
+		if !paired[1][j] {
+			_, err := fmt.Fprintf(wtr, "%s\t%s\t-\t%d\t-\t-\t%s\tmate2\t%s\n", base, gene, h.pos, h.nmiss, h.strand)
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+}
+
+// pairMates combines the matches of the two mates of each paired-end
+// read.  Pairs whose mates match the same target with the expected
+// orientation and insert size are reported as pairs, other matches
+// are reported as singletons.
+func pairMates() {
+
+	if !config.Paired() {
+		return
+	}
+
+	logger.Print("Starting pairMates")
 
-	// Reader for the match file
 	inf, err := os.Open(config.ResultsFileName)
 	if err != nil {
 		panic(err)
 	}
 	defer inf.Close()
 
-	// Build a bloom filter based on the matched sequences
-	billion := uint(1000 * 1000 * 1000)
-	bf := bloom.New(4*billion, 5)
-	scanner := bufio.NewScanner(inf)
-	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	// Sort the mate matches by read name and target
+	cmd := exec.Command("sort", "-S", "2G", "--parallel=8", "-t\t", "-k1,1", "-k3,3")
+	cmd.Env = os.Environ()
+	cmd.Stderr = os.Stderr
+	sin, err := cmd.StdinPipe()
+	if err != nil {
+		panic(err)
+	}
+	sout, err := cmd.StdoutPipe()
+	if err != nil {
+		panic(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		panic(err)
+	}
+
+	// Split the read names of each match into one line per mate.
+	go func() {
+		wtr := bufio.NewWriter(sin)
+		scanner := bufio.NewScanner(inf)
+		scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+		var ntrunc int
+		for scanner.Scan() {
+			f := strings.Split(scanner.Text(), "\t")
+			for _, name := range strings.Split(f[7], ";") {
+				if strings.HasSuffix(name, "...") {
+					// The list of names was truncated
+					ntrunc++
+					continue
+				}
+				if len(name) < 3 {
+					continue
+				}
+				base, mate := name[0:len(name)-2], name[len(name)-1:]
+				_, err := fmt.Fprintf(wtr, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", base, mate, f[4], f[2], len(f[0]), f[3], f[8])
+				if err != nil {
+					panic(err)
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			panic(err)
+		}
+		if ntrunc > 0 {
+			logger.Printf("%d matches had truncated read name lists", ntrunc)
+		}
+		wtr.Flush()
+		sin.Close()
+	}()
+
+	// Open the pairs output file
+	ext := path.Ext(config.ResultsFileName)
+	outname := strings.TrimSuffix(config.ResultsFileName, ext) + ".pairs" + ext
+	out, err := os.Create(outname)
+	if err != nil {
+		panic(err)
+	}
+	defer out.Close()
+	wtr := bufio.NewWriter(out)
+	defer wtr.Flush()
+
+	var base, gene string
+	var hits [2][]mateHit
+	scanner := bufio.NewScanner(sout)
 	for scanner.Scan() {
-		f := bytes.Fields(scanner.Bytes())
-		bf.Add(f[0])
+		f := strings.Split(scanner.Text(), "\t")
+		if f[0] != base || f[2] != gene {
+			if base != "" {
+				writePairs(wtr, base, gene, hits)
+			}
+			base, gene = f[0], f[2]
+			hits[0] = hits[0][0:0]
+			hits[1] = hits[1][0:0]
+		}
+
+		pos, err := strconv.Atoi(f[3])
+		if err != nil {
+			panic(err)
+		}
+		length, err := strconv.Atoi(f[4])
+		if err != nil {
+			panic(err)
+		}
+		h := mateHit{pos: pos, length: length, nmiss: f[5], strand: f[6]}
+		if f[1] == "1" {
+			hits[0] = append(hits[0], h)
+		} else {
+			hits[1] = append(hits[1], h)
+		}
 	}
 	if err := scanner.Err(); err != nil {
 		panic(err)
 	}
+	if base != "" {
+		writePairs(wtr, base, gene, hits)
+	}
 
-	// Open the nonmatch output file
+	if err := cmd.Wait(); err != nil {
+		panic(err)
+	}
+
+	logger.Printf("pairMates done")
+}
+
+// fastqName returns the name of a fastq output file, formed by
+// inserting the tag into the name of the results file.  The mate is 0
+// for single-end reads, otherwise the mate number is appended to the
+// tag.
+func fastqName(tag string, mate int) string {
 	a, b := path.Split(config.ResultsFileName)
 	c := strings.Split(b, ".")
 	d := c[len(c)-1]
-	c[len(c)-1] = "nonmatch"
+	c[len(c)-1] = tag
+	if mate > 0 {
+		c[len(c)-1] = fmt.Sprintf("%s_%d", tag, mate)
+	}
 	c = append(c, d+".fastq")
-	outname := path.Join(a, strings.Join(c, "."))
-	out, err := os.Create(outname)
+	return path.Join(a, strings.Join(c, "."))
+}
+
+// writeFastq writes one fastq record, using the fields of a line from
+// the raw read file (processed sequence, mate, sequence, qualities,
+// separator line and name line).  Records read from fastq files have
+// a separator line, and are written exactly as they were read.
+func writeFastq(wtr io.Writer, f [][]byte) {
+
+	seq, qual, sep, name := f[2], f[3], f[4], f[5]
+
+	// Reads from other formats have no fastq name or separator
+	// line, and reads from fasta or tab-delimited files have no
+	// qualities.
+	if len(sep) == 0 {
+		if len(qual) != len(seq) {
+			qual = bytes.Repeat([]byte{'!'}, len(seq))
+		}
+		if len(name) > 0 && name[0] == '>' {
+			name = name[1:]
+		}
+		name = append([]byte{'@'}, name...)
+		sep = []byte("+")
+	}
+
+	for _, x := range [][]byte{name, []byte("\n"), seq, []byte("\n"), sep, []byte("\n"), qual, []byte("\n")} {
+		_, err := wtr.Write(x)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// sortedPipe starts a command that writes to a sort process, and
+// returns a scanner for the sorted output.  The commands are appended
+// to cmds so that the caller can wait on them.
+func sortedPipe(src *exec.Cmd, sortargs []string, cmds []*exec.Cmd) (*bufio.Scanner, []*exec.Cmd) {
+
+	src.Env = os.Environ()
+	src.Stderr = os.Stderr
+
+	args := append([]string{"-S", "2G", "--parallel=8"}, sortargs...)
+	srt := exec.Command("sort", args...)
+	srt.Env = os.Environ()
+	srt.Stderr = os.Stderr
+
+	var err error
+	srt.Stdin, err = src.StdoutPipe()
 	if err != nil {
 		panic(err)
 	}
-	defer out.Close()
-	wtr := bufio.NewWriter(out)
-	defer wtr.Flush()
-
-	// Check each read to see if it was matched.
-	rfname := path.Join(tmpdir, "reads_sorted.txt.sz")
-	inf, err = os.Open(rfname)
+	pip, err := srt.StdoutPipe()
 	if err != nil {
 		panic(err)
 	}
-	defer inf.Close()
-	rdr := snappy.NewReader(inf)
-	scanner = bufio.NewScanner(rdr)
-	for scanner.Scan() {
-		f := bytes.Fields(scanner.Bytes())
-		if !bf.Test(f[0]) {
-			_, err := wtr.Write(f[2])
+
+	for _, c := range []*exec.Cmd{src, srt} {
+		if err := c.Start(); err != nil {
+			panic(err)
+		}
+	}
+
+	scanner := bufio.NewScanner(pip)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+
+	return scanner, append(cmds, src, srt)
+}
+
+// writeNonMatch writes the original fastq record of every read that
+// did not match any target, and of every read that did match a
+// target, to separate files.  For paired-end reads, each mate is
+// written to its own files.
+//
+// The raw reads and the matched sequences are both sorted by
+// sequence and merged, so that the split is exact.
+func writeNonMatch() {
+
+	logger.Print("Starting writeNonMatch")
+
+	var cmds []*exec.Cmd
+
+	// The distinct matched sequences
+	c := exec.Command("cut", "-f1", config.ResultsFileName)
+	mscan, cmds := sortedPipe(c, []string{"-u"}, cmds)
+
+	// The raw reads, sorted by processed sequence
+	rfname := path.Join(tmpdir, "reads_raw.txt.sz")
+	c = exec.Command("sztool", "-d", rfname)
+	rscan, cmds := sortedPipe(c, []string{"-t\t", "-k1,1"}, cmds)
+
+	// Open the output files
+	var mates []int
+	if !config.Paired() {
+		mates = []int{0}
+	} else {
+		mates = []int{1, 2}
+	}
+	nwtrs := make(map[byte]*bufio.Writer)
+	mwtrs := make(map[byte]*bufio.Writer)
+	for _, mate := range mates {
+		for _, tag := range []string{"nonmatch", "match"} {
+			out, err := os.Create(fastqName(tag, mate))
 			if err != nil {
 				panic(err)
 			}
-			_, err = wtr.Write([]byte("\n"))
-			if err != nil {
-				panic(err)
+			defer out.Close()
+			wtr := bufio.NewWriter(out)
+			defer wtr.Flush()
+			if tag == "match" {
+				mwtrs[byte('0'+mate)] = wtr
+			} else {
+				nwtrs[byte('0'+mate)] = wtr
 			}
-			_, err = wtr.Write(f[0])
-			if err != nil {
-				panic(err)
+		}
+	}
+
+	// The current matched sequence
+	var mseq []byte
+	mok := mscan.Scan()
+	if mok {
+		mseq = append(mseq[0:0], mscan.Bytes()...)
+	}
+
+	var nread, nnon int
+	for rscan.Scan() {
+		f := bytes.SplitN(rscan.Bytes(), []byte("\t"), 6)
+		nread++
+
+		// Advance the matched sequences to the current read
+		for mok && bytes.Compare(mseq, f[0]) < 0 {
+			mok = mscan.Scan()
+			if mok {
+				mseq = append(mseq[0:0], mscan.Bytes()...)
 			}
-			_, err = wtr.Write([]byte("\n+\n"))
-			if err != nil {
-				panic(err)
+		}
+
+		if mok && bytes.Equal(mseq, f[0]) {
+			writeFastq(mwtrs[f[1][0]], f)
+		} else {
+			nnon++
+			writeFastq(nwtrs[f[1][0]], f)
+		}
+	}
+
+	// Read to EOF before calling wait.
+	for mscan.Scan() {
+	}
+	for _, scanner := range []*bufio.Scanner{rscan, mscan} {
+		if err := scanner.Err(); err != nil {
+			panic(err)
+		}
+	}
+	for _, c := range cmds {
+		if err := c.Wait(); err != nil {
+			panic(err)
+		}
+	}
+
+	logger.Printf("%d of %d reads did not match", nnon, nread)
+	logger.Printf("writeNonMatch done")
+}
+
+// targetFeatures returns the features overlapping a match, given the
+// target id, the position of the match (zero-based), its length and
+// the target length.  Target ids from FASTA files start with '>' and
+// may be followed by a description, which are removed.  Reverse
+// complement targets (made by prep_targets -rev) have ids ending in
+// _r, and their positions are converted to the forward strand.  The
+// ids of targets collapsed by prep_targets -dedup are separated by
+// semicolons, and the features of each of them are included.
+func targetFeatures(idx *utils.AnnotationIndex, id string, pos, length, tlen int, buf []*utils.Feature) []*utils.Feature {
+
+	firstWord := func(s string) string {
+		if i := strings.IndexAny(s, " \t"); i >= 0 {
+			return s[0:i]
+		}
+		return s
+	}
+
+	n := len(buf)
+	for _, id := range strings.Split(id, ";") {
+
+		id = strings.TrimPrefix(id, ">")
+		p := pos
+
+		// The _r suffix follows the description, if there is one.
+		if strings.HasSuffix(id, "_r") && !idx.Has(id) {
+			if base := firstWord(strings.TrimSuffix(id, "_r")); idx.Has(base) {
+				id = base
+				p = tlen - pos - length
 			}
-			_, err = wtr.Write(bytes.Repeat([]byte{'!'}, len(f[0])))
-			if err != nil {
-				panic(err)
+		}
+		id = firstWord(id)
+
+		// Collapsed targets may name the same sequence twice.
+		m := len(buf)
+		buf = idx.Overlaps(id, p+1, p+length, buf)
+		for _, ft := range buf[m:] {
+			dup := false
+			for _, g := range buf[n:m] {
+				if g == ft {
+					dup = true
+					break
+				}
 			}
-			_, err = wtr.Write([]byte("\n"))
-			if err != nil {
-				panic(err)
+			if !dup {
+				buf[m] = ft
+				m++
 			}
 		}
+		buf = buf[0:m]
 	}
 
-	logger.Printf("writeNonMatch done")
+	return buf
+}
+
+// annotateMatches adds a column to the results file listing the
+// features from AnnotationFileName that each match overlaps, as
+// type:id separated by commas, or "-" if there are none.  The
+// results file is rewritten, replacing the column if it is already
+// present (e.g. when restarting at this step).
+func annotateMatches() {
+
+	if config.AnnotationFileName == "" {
+		return
+	}
+
+	logger.Print("Starting annotateMatches")
+
+	idx := utils.ReadAnnotations(config.AnnotationFileName, config.AnnotationTypes)
+
+	inf, err := os.Open(config.ResultsFileName)
+	if err != nil {
+		panic(err)
+	}
+	defer inf.Close()
+
+	tmpname := config.ResultsFileName + ".tmp"
+	out, err := os.Create(tmpname)
+	if err != nil {
+		panic(err)
+	}
+	wtr := bufio.NewWriter(out)
+
+	var buf []*utils.Feature
+	var nmatch, nannot int
+	scanner := bufio.NewScanner(inf)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		f := strings.Split(scanner.Text(), "\t")
+		if len(f) > 12 {
+			f = f[0:12]
+		}
+
+		pos, err := strconv.Atoi(f[2])
+		if err != nil {
+			panic(err)
+		}
+		tlen, err := strconv.Atoi(f[5])
+		if err != nil {
+			panic(err)
+		}
+
+		buf = targetFeatures(idx, f[4], pos, len(f[1]), tlen, buf[0:0])
+		var ann []string
+		for _, ft := range buf {
+			if ft.ID == "" {
+				ann = append(ann, ft.Type)
+			} else {
+				ann = append(ann, ft.Type+":"+ft.ID)
+			}
+		}
+		a := "-"
+		if len(ann) > 0 {
+			a = strings.Join(ann, ",")
+			nannot++
+		}
+		nmatch++
+
+		_, err = fmt.Fprintf(wtr, "%s\t%s\n", strings.Join(f, "\t"), a)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	if err := wtr.Flush(); err != nil {
+		panic(err)
+	}
+	if err := out.Close(); err != nil {
+		panic(err)
+	}
+	if err := os.Rename(tmpname, config.ResultsFileName); err != nil {
+		panic(err)
+	}
+
+	logger.Printf("%d of %d matches overlap an annotated feature", nannot, nmatch)
+	logger.Printf("annotateMatches done")
 }
 
 func run() {
@@ -972,8 +1796,16 @@ func run() {
 	}
 
 	if startpoint <= 10 {
+		pairMates()
+	}
+
+	if startpoint <= 11 {
 		writeNonMatch()
 	}
+
+	if startpoint <= 12 {
+		annotateMatches()
+	}
 }
 
 func main() {
@@ -0,0 +1,13 @@
+#!/bin/sh
+# Runs runmatch without a SampleSeed, and checks that the seed that it
+# chooses is recorded in the copy of the configuration in TempDir.
+
+d=data/muscato/21
+runmatch -ConfigFileName=$d/config_seed.json 2> $d/stderr.txt || exit 1
+seed=$(sed -n 's/^SampleSeed not provided, using //p' $d/stderr.txt)
+if [ -n "$seed" ] && grep -q "\"SampleSeed\":$seed[,}]" $d/tmp/config.json; then
+    echo "seed recorded" > $d/seed.txt
+else
+    echo "seed not recorded" > $d/seed.txt
+fi
+rm -f $d/stderr.txt
@@ -0,0 +1,6 @@
+#!/bin/sh
+# Runs runmatch with the (compressed) reads piped through standard
+# input.
+
+d=data/muscato/23
+cat $d/reads.fastq.gz | runmatch -ConfigFileName=$d/config.json
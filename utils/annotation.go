@@ -0,0 +1,202 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Feature is one feature from a GFF3 or GTF annotation file.  The
+// coordinates are one-based and inclusive, as in the file.
+type Feature struct {
+	Seqid string
+	Type  string
+	ID    string
+	Start int
+	End   int
+}
+
+// intervals holds the features of one sequence, sorted by start
+// position.  maxEnd[i] is the largest end position among the first
+// i+1 features, which is non-decreasing, so the features that may
+// overlap a query form a range that is found by binary search.
+type intervals struct {
+	features []*Feature
+	maxEnd   []int
+}
+
+// AnnotationIndex finds the features that overlap a range of
+// positions in a sequence.
+type AnnotationIndex struct {
+	seqs map[string]*intervals
+}
+
+// gffAttribute returns the value of a GFF3 attribute (key=value pairs
+// separated by semicolons), or an empty string.
+func gffAttribute(attrs, key string) string {
+	for _, a := range strings.Split(attrs, ";") {
+		kv := strings.SplitN(strings.TrimSpace(a), "=", 2)
+		if len(kv) == 2 && kv[0] == key {
+			v, err := url.PathUnescape(kv[1])
+			if err != nil {
+				return kv[1]
+			}
+			return v
+		}
+	}
+	return ""
+}
+
+// gtfAttribute returns the value of a GTF attribute (key "value" pairs
+// separated by semicolons), or an empty string.
+func gtfAttribute(attrs, key string) string {
+	for _, a := range strings.Split(attrs, ";") {
+		kv := strings.SplitN(strings.TrimSpace(a), " ", 2)
+		if len(kv) == 2 && kv[0] == key {
+			return strings.Trim(strings.TrimSpace(kv[1]), "\"")
+		}
+	}
+	return ""
+}
+
+// featureID returns an identifier for a feature, from the ID or Name
+// attribute of a GFF3 feature, or the transcript_id or gene_id
+// attribute of a GTF feature.
+func featureID(attrs string) string {
+
+	// GTF attribute values are quoted
+	if strings.Contains(attrs, "\"") {
+		for _, k := range []string{"transcript_id", "gene_id"} {
+			if v := gtfAttribute(attrs, k); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	for _, k := range []string{"ID", "Name"} {
+		if v := gffAttribute(attrs, k); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// ReadAnnotations reads the features in a GFF3 or GTF file, which may
+// be compressed.  If types is not empty, only features of these types
+// are used.
+func ReadAnnotations(fname string, types []string) *AnnotationIndex {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	rdr := Decompress(fid)
+	defer rdr.Close()
+
+	usetype := make(map[string]bool)
+	for _, t := range types {
+		usetype[t] = true
+	}
+
+	idx := &AnnotationIndex{seqs: make(map[string]*intervals)}
+	scanner := bufio.NewScanner(rdr)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for lnum := 1; scanner.Scan(); lnum++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		// Sequences may follow the features in a GFF3 file
+		if line == "##FASTA" {
+			break
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		f := strings.Split(line, "\t")
+		if len(f) < 8 {
+			panic(fmt.Sprintf("%s: line %d has fewer than 8 fields", fname, lnum))
+		}
+		if len(usetype) > 0 && !usetype[f[2]] {
+			continue
+		}
+		start, err1 := strconv.Atoi(f[3])
+		end, err2 := strconv.Atoi(f[4])
+		if err1 != nil || err2 != nil {
+			panic(fmt.Sprintf("%s: line %d has invalid coordinates", fname, lnum))
+		}
+
+		ft := &Feature{Seqid: f[0], Type: f[2], Start: start, End: end}
+		if len(f) > 8 {
+			ft.ID = featureID(f[8])
+		}
+
+		iv := idx.seqs[ft.Seqid]
+		if iv == nil {
+			iv = new(intervals)
+			idx.seqs[ft.Seqid] = iv
+		}
+		iv.features = append(iv.features, ft)
+	}
+
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	for _, iv := range idx.seqs {
+		sort.SliceStable(iv.features, func(i, j int) bool {
+			return iv.features[i].Start < iv.features[j].Start
+		})
+		iv.maxEnd = make([]int, len(iv.features))
+		for i, ft := range iv.features {
+			iv.maxEnd[i] = ft.End
+			if i > 0 && iv.maxEnd[i-1] > ft.End {
+				iv.maxEnd[i] = iv.maxEnd[i-1]
+			}
+		}
+	}
+
+	return idx
+}
+
+// Has returns true if there are any features on the given sequence.
+func (idx *AnnotationIndex) Has(seqid string) bool {
+	_, ok := idx.seqs[seqid]
+	return ok
+}
+
+// Overlaps appends to buf the features of a sequence that overlap
+// the positions from start to end (one-based and inclusive), in order
+// of their start positions.
+func (idx *AnnotationIndex) Overlaps(seqid string, start, end int, buf []*Feature) []*Feature {
+
+	iv := idx.seqs[seqid]
+	if iv == nil {
+		return buf
+	}
+
+	// The features that start after the end of the range cannot
+	// overlap it.
+	n := sort.Search(len(iv.features), func(i int) bool {
+		return iv.features[i].Start > end
+	})
+
+	// The features before the first one with maxEnd reaching the
+	// range cannot overlap it.
+	m := sort.Search(n, func(i int) bool {
+		return iv.maxEnd[i] >= start
+	})
+
+	for _, ft := range iv.features[m:n] {
+		if ft.End >= start {
+			buf = append(buf, ft)
+		}
+	}
+
+	return buf
+}
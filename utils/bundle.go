@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// TargetFormatVersion is the version of the target bundle format
+// written by prep_targets.  It is increased whenever the layout of
+// the sequence or id files changes.  Version 2 allows rows of targets
+// that have been removed, which have an empty sequence and no id.
+const TargetFormatVersion = 2
+
+// TargetManifestName is the name of the manifest file in a target
+// bundle directory.
+const TargetManifestName = "manifest.json"
+
+// BundleFile describes one file, by its name, size in bytes and
+// SHA-256 checksum (in hexadecimal).
+type BundleFile struct {
+	Name   string
+	Size   int64
+	SHA256 string
+}
+
+// TargetManifest describes a target bundle, which is a directory
+// containing the sequence and id files produced by prep_targets,
+// along with this manifest, stored as manifest.json.
+type TargetManifest struct {
+
+	// The version of the bundle format
+	FormatVersion int
+
+	// The time that the bundle was created, in RFC 3339 format
+	Created string
+
+	// The command line of prep_targets
+	CommandLine []string
+
+	// The input files, with their sizes and checksums
+	Sources []BundleFile
+
+	// The number of target sequences (rows of the sequence and id
+	// files)
+	NumSequences int
+
+	// The total length of all target sequences
+	TotalBases int64
+
+	// The options that were used to prepare the targets
+	Rev       bool
+	Mask      string
+	Dedup     string
+	Features  []string
+	Qualifier string
+
+	// The number of rows of targets that have been removed.  These
+	// rows have an empty sequence and no id, so that the other rows
+	// keep their numbers.
+	NumRemoved int
+
+	// The changes made to the bundle after it was created
+	Updates []TargetUpdate
+
+	// The sequence and id files, with names relative to the
+	// bundle directory
+	SeqFile BundleFile
+	IdFile  BundleFile
+}
+
+// TargetUpdate records a change made to an existing target bundle.
+type TargetUpdate struct {
+
+	// The time of the change, in RFC 3339 format
+	Time string
+
+	// The command line of prep_targets
+	CommandLine []string
+
+	// The number of rows appended and removed
+	Appended int
+	Removed  int
+}
+
+// NewBundleFile returns the description of a file, which is named by
+// name.  The file is read to compute its checksum.
+func NewBundleFile(fname, name string) BundleFile {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, fid)
+	if err != nil {
+		panic(err)
+	}
+
+	return BundleFile{Name: name, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}
+}
+
+// ReadTargetManifest reads the manifest of the target bundle in the
+// given directory.
+func ReadTargetManifest(dir string) (*TargetManifest, error) {
+
+	fid, err := os.Open(path.Join(dir, TargetManifestName))
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+
+	m := new(TargetManifest)
+	if err := json.NewDecoder(fid).Decode(m); err != nil {
+		return nil, fmt.Errorf("%s: %v", path.Join(dir, TargetManifestName), err)
+	}
+
+	return m, nil
+}
+
+// Write writes the manifest into the given bundle directory.
+func (m *TargetManifest) Write(dir string) {
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	err = ioutil.WriteFile(path.Join(dir, TargetManifestName), append(b, '\n'), 0644)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Validate checks that the bundle in the given directory has a
+// supported format version, and that its sequence and id files match
+// the sizes and checksums recorded in the manifest.
+func (m *TargetManifest) Validate(dir string) error {
+
+	if m.FormatVersion < 1 || m.FormatVersion > TargetFormatVersion {
+		return fmt.Errorf("%s has format version %d, but only versions up to %d are supported",
+			path.Join(dir, TargetManifestName), m.FormatVersion, TargetFormatVersion)
+	}
+
+	for _, f := range []BundleFile{m.SeqFile, m.IdFile} {
+		fname := path.Join(dir, f.Name)
+		fi, err := os.Stat(fname)
+		if err != nil {
+			return err
+		}
+		if fi.Size() != f.Size {
+			return fmt.Errorf("%s has size %d, but the manifest gives %d", fname, fi.Size(), f.Size)
+		}
+		if g := NewBundleFile(fname, f.Name); g.SHA256 != f.SHA256 {
+			return fmt.Errorf("the checksum of %s does not match the manifest", fname)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"log"
+	"math"
+)
+
+// The names of the complexity filters, in the order that they are
+// applied.
+var filterNames = []string{"dinucleotide", "DUST", "entropy", "homopolymer"}
+
+// ComplexityFilter rejects low-complexity windows, using the filters
+// that are enabled in the configuration.  A window is counted as
+// dropped by the first filter that rejects it.
+type ComplexityFilter struct {
+	config *Config
+
+	// Workspaces for counting dinucleotides, triplets and k-mers
+	wk    []int
+	wt    []int
+	wkmer []int
+
+	// The number of windows dropped by each filter
+	dropped []int
+}
+
+// NewComplexityFilter returns a ComplexityFilter using the settings
+// in config.
+func NewComplexityFilter(config *Config) *ComplexityFilter {
+
+	cf := &ComplexityFilter{
+		config:  config,
+		wk:      make([]int, 25),
+		wt:      make([]int, 64),
+		dropped: make([]int, len(filterNames)),
+	}
+
+	if config.MinEntropy > 0 {
+		cf.wkmer = make([]int, 1<<uint(2*config.EntropyWidth()))
+	}
+
+	return cf
+}
+
+// Check returns true if the window passes all of the complexity
+// filters.
+func (cf *ComplexityFilter) Check(seq []byte) bool {
+
+	config := cf.config
+
+	switch {
+	case config.MinDinuc > 0 && CountDinuc(seq, cf.wk) < config.MinDinuc:
+		cf.dropped[0]++
+	case config.MaxDust > 0 && DustScore(seq, cf.wt) > config.MaxDust:
+		cf.dropped[1]++
+	case config.MinEntropy > 0 && KmerEntropy(seq, config.EntropyWidth(), cf.wkmer) < config.MinEntropy:
+		cf.dropped[2]++
+	case config.MaxHomopolymer > 0 && MaxRun(seq) > config.MaxHomopolymer:
+		cf.dropped[3]++
+	default:
+		return true
+	}
+
+	return false
+}
+
+// LogDropped writes the number of windows dropped by each enabled
+// filter to the log.
+func (cf *ComplexityFilter) LogDropped(logger *log.Logger) {
+
+	enabled := []bool{
+		cf.config.MinDinuc > 0,
+		cf.config.MaxDust > 0,
+		cf.config.MinEntropy > 0,
+		cf.config.MaxHomopolymer > 0,
+	}
+
+	for j, name := range filterNames {
+		if enabled[j] {
+			logger.Printf("The %s filter dropped %d windows", name, cf.dropped[j])
+		}
+	}
+}
+
+// baseCode returns 0, 1, 2, 3 for A, C, G, T, and -1 for any other
+// letter.
+func baseCode(x byte) int {
+	switch x {
+	case 'A':
+		return 0
+	case 'C':
+		return 1
+	case 'G':
+		return 2
+	case 'T':
+		return 3
+	}
+	return -1
+}
+
+// DustScore returns the DUST score of a sequence, which is large for
+// sequences that contain many repeated triplets.  If c_t is the
+// number of times that triplet t occurs, and l is the number of
+// triplets, the score is sum_t c_t*(c_t-1)/2 / (l-1).  Triplets
+// containing letters other than A/T/G/C are not counted.  The
+// workspace wk must have length 64.
+func DustScore(seq []byte, wk []int) float64 {
+
+	for i := range wk {
+		wk[i] = 0
+	}
+
+	if len(seq) < 4 {
+		return 0
+	}
+
+	var score int
+	for i := 0; i+3 <= len(seq); i++ {
+		a, b, c := baseCode(seq[i]), baseCode(seq[i+1]), baseCode(seq[i+2])
+		if a < 0 || b < 0 || c < 0 {
+			continue
+		}
+		t := 16*a + 4*b + c
+
+		// Adding the c'th copy of a triplet increases the sum
+		// by c-1.
+		score += wk[t]
+		wk[t]++
+	}
+
+	l := len(seq) - 2
+	return float64(score) / float64(l-1)
+}
+
+// KmerEntropy returns the Shannon entropy (in bits) of the
+// distribution of k-mers in a sequence.  K-mers containing letters
+// other than A/T/G/C are not counted.  The workspace wk must have
+// length 4^k.
+func KmerEntropy(seq []byte, k int, wk []int) float64 {
+
+	for i := range wk {
+		wk[i] = 0
+	}
+
+	var n int
+	for i := 0; i+k <= len(seq); i++ {
+		var x int
+		for _, c := range seq[i : i+k] {
+			v := baseCode(c)
+			if v < 0 {
+				x = -1
+				break
+			}
+			x = 4*x + v
+		}
+		if x >= 0 {
+			wk[x]++
+			n++
+		}
+	}
+
+	var e float64
+	for _, c := range wk {
+		if c > 0 {
+			p := float64(c) / float64(n)
+			e -= p * math.Log2(p)
+		}
+	}
+
+	return e
+}
+
+// MaxRun returns the length of the longest run of a single letter in
+// a sequence.
+func MaxRun(seq []byte) int {
+
+	var mx, n int
+	for i := range seq {
+		if i > 0 && seq[i] == seq[i-1] {
+			n++
+		} else {
+			n = 1
+		}
+		if n > mx {
+			mx = n
+		}
+	}
+
+	return mx
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	// Leading bytes of a gzip stream.
+	gzipMagic = []byte{0x1f, 0x8b}
+
+	// Leading bytes of a bzip2 stream.
+	bzip2Magic = []byte("BZh")
+
+	// Leading bytes of a zstd frame.
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Decompress returns a reader that produces the decompressed contents
+// of r.  Gzip, bzip2 and zstd compression are recognized by their
+// magic bytes, so the file name does not need to have any particular
+// suffix.  Data that do not start with one of these magic values are
+// passed through unchanged.
+func Decompress(r io.Reader) io.ReadCloser {
+
+	br := bufio.NewReader(r)
+
+	// Peek returns an error if the stream is shorter than the
+	// requested number of bytes, in which case we look at whatever
+	// is available.
+	magic, _ := br.Peek(len(zstdMagic))
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		// Multistream is on by default, so concatenated gzip
+		// files (e.g. from pigz or BGZF) are read to the end.
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			panic(err)
+		}
+		return gz
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return ioutil.NopCloser(bzip2.NewReader(br))
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			panic(err)
+		}
+		return zr.IOReadCloser()
+	default:
+		return ioutil.NopCloser(br)
+	}
+}
@@ -7,15 +7,59 @@ import (
 
 type Config struct {
 
-	// The name of the fastq file containing the reads.
+	// The name of the fastq file containing the reads.  This may
+	// be a glob pattern matching several files.
 	ReadFileName string
 
+	// For paired-end data, the name of the file containing the
+	// second mate of each read in ReadFileName, in the same order.
+	ReadFileName2 string
+
+	// Additional read files (or glob patterns), processed after
+	// ReadFileName.  For paired-end data, ReadFileNames2 contains
+	// the corresponding files of second mates.
+	ReadFileNames  []string
+	ReadFileNames2 []string
+
+	// A file listing read files, one per line.  Each line may also
+	// contain the name of the corresponding file of second mates.
+	ReadManifest string
+
+	// The format of the read file, either "fastq", "fasta", "tab"
+	// (id<tab>sequence on each line), "sam" or "bam".  If blank,
+	// the format is detected from the contents of the file.
+	ReadFormat string
+
+	// Either "strict" (default) or "lenient".  In strict mode, a
+	// malformed fastq record stops the run with an error giving
+	// the file and line of the record.  In lenient mode,
+	// malformed records are skipped and counted in
+	// prep_reads.log.
+	ReadValidation string
+
+	// If true, each SAM or BAM read file contains the first and
+	// second mates of each pair in consecutive records.  runmatch
+	// sets this when the first record of the first read file is a
+	// mate, unless the reads are given on standard input or a
+	// named pipe.
+	InterleavedPairs bool
+
 	// The name of the file containing the genes.
 	GeneFileName string
 
 	// Gene ids
 	GeneIdFileName string
 
+	// A GFF3 or GTF file of features on the target sequences.  If
+	// given, each match is annotated with the features that it
+	// overlaps.  The first column of the file must contain the
+	// target ids.
+	AnnotationFileName string
+
+	// If not empty, only features of these types (e.g. "gene",
+	// "CDS") are used to annotate matches.
+	AnnotationTypes []string
+
 	// The path where the results are written
 	ResultsFileName string
 
@@ -34,10 +78,29 @@ type Config struct {
 	// The minimum allowed proportion matching values.
 	PMatch float64
 
+	// The read strands to search, either "forward" (default),
+	// "reverse" (the reverse complement of each read) or "both".
+	SearchStrand string
+
 	// The exact-match window must have this many distinct
 	// dinucleotides.
 	MinDinuc int
 
+	// If positive, windows with a DUST score greater than MaxDust
+	// are not used.  The DUST score is large for windows
+	// containing many repeated triplets.
+	MaxDust float64
+
+	// If positive, windows for which the Shannon entropy (in bits)
+	// of the k-mer distribution is less than MinEntropy are not
+	// used.  The k-mer length is EntropyK, defaults to 2.
+	MinEntropy float64
+	EntropyK   int
+
+	// If positive, windows containing a run of a single letter
+	// longer than MaxHomopolymer are not used.
+	MaxHomopolymer int
+
 	// Use this location to place temporary files.  If blank or
 	// missing, a temporary file name is generated.
 	TempDir string
@@ -48,6 +111,107 @@ type Config struct {
 	// Truncate all reads at this length.
 	MaxReadLength int
 
+	// Adapter sequences to be trimmed from the 3' end of each
+	// read.  The read is cut at the leftmost position where an
+	// adapter starts.  The adapter may extend past the end of the
+	// read.
+	Adapters []string
+
+	// Primer sequences to be trimmed from the 5' end of each
+	// read.  The read may start partway through the primer.
+	Primers []string
+
+	// The number of mismatches allowed when matching a full
+	// length adapter or primer.  Partial overlaps are allowed
+	// proportionally fewer mismatches.
+	AdapterMismatches int
+
+	// The minimum number of positions in which an adapter or
+	// primer must overlap a read for it to be trimmed, defaults to
+	// 3.
+	AdapterMinOverlap int
+
+	// If true, a run of A at the 3' end of each read (poly-A
+	// tail) is trimmed.
+	TrimPolyA bool
+
+	// If true, a run of T at the 5' end of each read (poly-T head)
+	// is trimmed.
+	TrimPolyT bool
+
+	// If true, a run of any single letter at the 3' end of each
+	// read is trimmed.
+	TrimHomopolymer bool
+
+	// The minimum length of a poly-A, poly-T or homopolymer run to
+	// be trimmed, defaults to 8.
+	TailMinLength int
+
+	// The number of other letters allowed within a poly-A, poly-T
+	// or homopolymer run.
+	TailMismatches int
+
+	// The offset of the Phred quality scores in the fastq file,
+	// defaults to 33.
+	QualityOffset int
+
+	// If positive, bases are trimmed from the 3' end of each read
+	// while the mean quality of the TrimWindow bases ending at the
+	// 3' end is less than TrimQuality.  Trimming takes place
+	// before MinReadLength and MaxReadLength are applied.
+	TrimQuality int
+
+	// The width of the sliding window used for quality trimming,
+	// defaults to 1.
+	TrimWindow int
+
+	// If positive, bases with quality less than MaskQuality are
+	// replaced with X.
+	MaskQuality int
+
+	// A file of sample barcodes for reads pooled from several
+	// samples, with a barcode and a sample name on each line.  The
+	// barcode is matched against the 5' end of each read (the
+	// first mate for paired-end data) and removed, and the read is
+	// tagged with the sample.  Reads that do not match a barcode
+	// are not used.
+	BarcodeFileName string
+
+	// The number of mismatches allowed when matching a barcode.
+	BarcodeMismatches int
+
+	// A regular expression used to extract a unique molecular
+	// identifier (UMI) from the name line of each read.  If the
+	// expression has a parenthesized group, the first group is the
+	// UMI, otherwise the entire match is the UMI.  Reads whose
+	// names do not match have a blank UMI.
+	UMIPattern string
+
+	// If UMILength is positive, the UMI is taken from the read
+	// sequence, starting at position UMIStart (zero-based).  All
+	// bases up to the end of the UMI are removed from the read
+	// before any other processing.  For paired-end data the UMI
+	// is taken from the first mate.
+	UMIStart  int
+	UMILength int
+
+	// If positive, only the first MaxReads reads (or pairs) are
+	// used, which is useful for quickly trying out parameters.
+	MaxReads int
+
+	// If positive, each read (or pair) is used with probability
+	// SampleFraction.
+	SampleFraction float64
+
+	// If positive, a random sample of SampleCount reads (or pairs)
+	// is used.
+	SampleCount int
+
+	// The seed for random sampling of the reads.  If zero when
+	// sampling, runmatch chooses a seed and records it in the copy
+	// of the configuration in the workspace directory.
+	SampleSeed int64
+
 	// Return at most this many matches for each read, defaults to
 	// 1.
 	MaxMatches int
@@ -66,6 +230,34 @@ type Config struct {
 	// the MaxMatches matches for each window with the fewest
 	// mismatched values.
 	MatchMode string
+
+	// For paired-end data, the smallest and largest insert sizes
+	// (distance from the start of the first mate to the end of the
+	// second mate on the target) for a pair to be reported as
+	// concordant.
+	MinInsertSize int
+	MaxInsertSize int
+}
+
+// Strands returns the read orientations that are searched, '+' for
+// the read as given and '-' for its reverse complement.
+func (config *Config) Strands() []byte {
+	switch config.SearchStrand {
+	case "reverse":
+		return []byte{'-'}
+	case "both":
+		return []byte{'+', '-'}
+	default:
+		return []byte{'+'}
+	}
+}
+
+// EntropyWidth returns the k-mer length used by the entropy filter.
+func (config *Config) EntropyWidth() int {
+	if config.EntropyK == 0 {
+		return 2
+	}
+	return config.EntropyK
 }
 
 func ReadConfig(filename string) *Config {
@@ -2,56 +2,119 @@ package utils
 
 import (
 	"bufio"
+	"fmt"
+	"io"
 	"os"
 	"path"
 )
 
-// ReadInSeq reads the sequencing reads, returns names and sequences
+const (
+	// The maximum length of one line in a read file.
+	maxReadLine = 1024 * 1024
+)
+
+// ReadInSeq reads the sequencing reads, returns names and sequences.
+// Gzip, bzip2 and zstd compressed files are decompressed on the fly.
+// The reads can be in fastq, fasta, tab-delimited (id<tab>sequence),
+// SAM or BAM format.
 type ReadInSeq struct {
-	file    *os.File
-	scanner *bufio.Scanner
-	Name    string
-	Seq     string
-}
+	file   *os.File
+	rdr    io.ReadCloser
+	parser readParser
+	Format string
+	Name   string
+	Seq    string
 
-func NewReadInSeq(seqfile, dpath string) *ReadInSeq {
-	inf, err := os.Open(path.Join(dpath, seqfile))
-	if err != nil {
-		panic(err)
-	}
+	// The quality scores, blank for formats without qualities.
+	Qual string
 
-	scanner := bufio.NewScanner(inf)
+	// The separator line of a fastq record, starting with '+',
+	// blank for other formats.
+	Sep string
 
-	return &ReadInSeq{
-		file:    inf,
-		scanner: scanner,
-	}
-}
+	// For SAM and BAM files, the sample (SM) of the read group of
+	// the read, or the read group ID if it has no sample.
+	Sample string
 
-func (ris *ReadInSeq) Next() bool {
+	// For SAM and BAM files, 1 or 2 if the read is the first or
+	// second mate of a pair, otherwise 0.
+	Mate int
 
-	for j := 0; j < 4; j++ {
+	// If false (the default), a malformed fastq record causes a
+	// panic identifying the file and line.  If true, malformed
+	// records are skipped and counted in Skipped.
+	Lenient bool
 
-		if !ris.scanner.Scan() {
+	// The number of malformed records that were skipped.
+	Skipped int
+}
 
-			if err := ris.scanner.Err(); err != nil {
-				panic(err)
-			}
+// NewReadInSeq opens a file of sequencing reads.  The format should
+// be one of "fastq", "fasta", "tab", "sam" or "bam", or blank to detect the format
+// from the contents of the file.  If seqfile is "-", the reads are
+// read from standard input.  The file is read sequentially, so it may
+// also be a named pipe.
+func NewReadInSeq(seqfile, dpath, format string) *ReadInSeq {
 
-			return false
+	var inf *os.File
+	var fname string
+	if IsStdin(seqfile) {
+		inf = os.Stdin
+		fname = "standard input"
+	} else {
+		fname = path.Join(dpath, seqfile)
+		var err error
+		inf, err = os.Open(fname)
+		if err != nil {
+			panic(err)
 		}
+	}
 
-		switch j % 4 {
-		case 0:
-			ris.Name = ris.scanner.Text()
-		case 1:
-			ris.Seq = ris.scanner.Text()
-		}
+	rdr := Decompress(inf)
+	br := bufio.NewReaderSize(rdr, maxReadLine)
+	if format == "" {
+		format = DetectReadFormat(br)
+	}
 
-		if err := ris.scanner.Err(); err != nil {
-			panic(err)
-		}
+	// The text formats are read line by line.
+	newScanner := func() *bufio.Scanner {
+		scanner := bufio.NewScanner(br)
+		scanner.Buffer(make([]byte, maxReadLine), maxReadLine)
+		return scanner
+	}
+
+	var parser readParser
+	switch format {
+	case "fastq":
+		parser = &fastqParser{scanner: newScanner(), filename: fname}
+	case "fasta":
+		parser = &fastaParser{scanner: newScanner()}
+	case "tab":
+		parser = &tabParser{scanner: newScanner()}
+	case "sam":
+		parser = newSamParser(newScanner(), fname)
+	case "bam":
+		parser = newBamParser(br, fname)
+	default:
+		panic(fmt.Sprintf("unknown read format '%s'", format))
+	}
+
+	return &ReadInSeq{
+		file:   inf,
+		rdr:    rdr,
+		parser: parser,
+		Format: format,
 	}
+}
 
-	return true
+// Close releases the decompressor and the underlying file.
+func (ris *ReadInSeq) Close() {
+	ris.rdr.Close()
+	ris.file.Close()
+}
+
+// Next advances to the next read, returning false when all reads
+// have been read.
+func (ris *ReadInSeq) Next() bool {
+	return ris.parser.next(ris)
 }
@@ -0,0 +1,93 @@
+package utils
+
+// The IUPAC nucleotide codes, with the bases that each code includes
+// encoded as a bit mask (A=1, C=2, G=4, T=8).
+var iupacCodes = map[byte]byte{
+	'A': 1, 'C': 2, 'G': 4, 'T': 8,
+	'R': 1 | 4, 'Y': 2 | 8, 'S': 2 | 4, 'W': 1 | 8,
+	'K': 4 | 8, 'M': 1 | 2,
+	'B': 2 | 4 | 8, 'D': 1 | 4 | 8, 'H': 1 | 2 | 8, 'V': 1 | 2 | 4,
+	'N': 1 | 2 | 4 | 8,
+}
+
+var (
+	// The bases included in each IUPAC code, zero for other
+	// letters.
+	iupacBits [256]byte
+
+	// The complement of each letter.  Letters that are not IUPAC
+	// codes are their own complement.
+	complement [256]byte
+
+	// baseMatch[t][r] is true if read letter r is consistent with
+	// target letter t.
+	baseMatch [256][256]bool
+)
+
+func init() {
+
+	for c, b := range iupacCodes {
+		iupacBits[c] = b
+	}
+
+	for i := range complement {
+		complement[i] = byte(i)
+	}
+	for c, b := range iupacCodes {
+		// Complementing swaps A with T and C with G.
+		cb := (b&1)<<3 | (b&8)>>3 | (b&2)<<1 | (b&4)>>1
+		for d, e := range iupacCodes {
+			if e == cb {
+				complement[c] = d
+
+				// Soft-masked (lower case) letters stay
+				// lower case.
+				complement[lower(c)] = lower(d)
+			}
+		}
+	}
+
+	for t := range baseMatch {
+		for r := range baseMatch[t] {
+			// Soft-masked target letters match in the same
+			// way as upper case letters.
+			rb, tb := iupacBits[r], iupacBits[upper(byte(t))]
+			baseMatch[t][r] = t == r || (rb != 0 && rb&tb == rb)
+		}
+	}
+}
+
+func lower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func upper(c byte) byte {
+	if c >= 'a' && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
+
+// IsSoftMasked returns true if c is a lower case IUPAC nucleotide
+// code, as used for soft-masked regions of reference sequences.
+func IsSoftMasked(c byte) bool {
+	return c != upper(c) && IsIUPAC(upper(c))
+}
+
+// IsIUPAC returns true if c is an upper case IUPAC nucleotide code.
+func IsIUPAC(c byte) bool {
+	return iupacBits[c] != 0
+}
+
+// BaseMatch returns true if the read letter r is consistent with the
+// target letter t, which may be an IUPAC ambiguity code, in upper or
+// lower (soft-masked) case.  Identical letters always match,
+// otherwise the bases included in r must also be included in t.  For
+// example, a read A matches a target R (A or G), but a read R does
+// not match a target A.
+func BaseMatch(t, r byte) bool {
+	return baseMatch[t][r]
+}
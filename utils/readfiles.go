@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// IsStdin returns true if a read file name refers to standard input.
+func IsStdin(fname string) bool {
+	return fname == "-"
+}
+
+// expandGlob returns the files matching a glob pattern, in sorted
+// order.  A pattern that matches no files is returned unchanged, so
+// that the missing file is reported when it is opened.
+func expandGlob(pattern string) []string {
+
+	m, err := filepath.Glob(pattern)
+	if err != nil {
+		panic(err)
+	}
+	if len(m) == 0 || IsStdin(pattern) {
+		return []string{pattern}
+	}
+	sort.Strings(m)
+
+	return m
+}
+
+// readManifest returns the files listed in a manifest file.  Each
+// line contains the name of a read file, optionally followed by the
+// name of the file containing the second mates.  Relative paths are
+// taken relative to the directory containing the manifest.  Blank
+// lines and lines starting with # are skipped.
+func readManifest(fname string) ([]string, []string) {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+
+	dir := path.Dir(fname)
+	resolve := func(f string) string {
+		if path.IsAbs(f) || IsStdin(f) {
+			return f
+		}
+		return path.Join(dir, f)
+	}
+
+	var files1, files2 []string
+	scanner := bufio.NewScanner(fid)
+	for lnum := 1; scanner.Scan(); lnum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		f := strings.Fields(line)
+		switch len(f) {
+		case 1:
+			files1 = append(files1, resolve(f[0]))
+		case 2:
+			files1 = append(files1, resolve(f[0]))
+			files2 = append(files2, resolve(f[1]))
+		default:
+			panic(fmt.Sprintf("%s: line %d should contain one or two file names", fname, lnum))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	if len(files2) > 0 && len(files2) != len(files1) {
+		panic(fmt.Sprintf("%s: either all or none of the lines should name a second mate file", fname))
+	}
+
+	return files1, files2
+}
+
+// ReadFiles returns the names of all the read files, from ReadFileName,
+// ReadFileNames and ReadManifest in that order, with glob patterns
+// expanded.  For paired-end data, the second value contains the
+// corresponding files of second mates, otherwise it is empty.
+func (config *Config) ReadFiles() ([]string, []string) {
+
+	var files1, files2 []string
+
+	if config.ReadFileName != "" {
+		files1 = append(files1, expandGlob(config.ReadFileName)...)
+	}
+	for _, f := range config.ReadFileNames {
+		files1 = append(files1, expandGlob(f)...)
+	}
+
+	if config.ReadFileName2 != "" {
+		files2 = append(files2, expandGlob(config.ReadFileName2)...)
+	}
+	for _, f := range config.ReadFileNames2 {
+		files2 = append(files2, expandGlob(f)...)
+	}
+
+	if config.ReadManifest != "" {
+		m1, m2 := readManifest(config.ReadManifest)
+		if (len(m2) > 0) != (len(files2) > 0) && len(files1) > 0 {
+			panic("the read manifest and the other read files should be either all paired or all unpaired")
+		}
+		files1 = append(files1, m1...)
+		files2 = append(files2, m2...)
+	}
+
+	if len(files2) > 0 && len(files2) != len(files1) {
+		panic(fmt.Sprintf("found %d read files but %d second mate files", len(files1), len(files2)))
+	}
+
+	return files1, files2
+}
+
+// Paired returns true if the reads are paired-end, with the mates
+// either in separate files or interleaved in the same file.
+func (config *Config) Paired() bool {
+	if config.InterleavedPairs {
+		return true
+	}
+	_, files2 := config.ReadFiles()
+	return len(files2) > 0
+}
+
+// ReadFileLabels returns a label for each read file, used to report
+// the number of copies of each read in each file.  The label is the
+// base name of the file, unless two files have the same base name,
+// in which case the full names are used.  Standard input is labeled
+// "stdin".
+func ReadFileLabels(files []string) []string {
+
+	labels := make([]string, len(files))
+	seen := make(map[string]bool)
+	for i, f := range files {
+		labels[i] = path.Base(f)
+		if IsStdin(f) {
+			labels[i] = "stdin"
+		}
+		if seen[labels[i]] {
+			return append([]string{}, files...)
+		}
+		seen[labels[i]] = true
+	}
+
+	return labels
+}
@@ -0,0 +1,336 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// A readParser extracts reads one at a time from a stream having a
+// particular format.
+type readParser interface {
+
+	// next places the name, sequence and (if available)
+	// qualities of the next read into ris, returning false when
+	// there are no more reads.
+	next(ris *ReadInSeq) bool
+}
+
+// firstLines returns up to n non-blank lines from the start of buf.
+func firstLines(buf []byte, n int) [][]byte {
+	var lines [][]byte
+	for _, line := range bytes.Split(buf, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+		if len(lines) == n {
+			break
+		}
+	}
+	return lines
+}
+
+// samHeader matches the start of a SAM header line, such as "@HD\t".
+func samHeader(line []byte) bool {
+	return len(line) >= 4 && line[0] == '@' && line[3] == '\t' &&
+		isUpper(line[1]) && isUpper(line[2])
+}
+
+func isUpper(c byte) bool {
+	return c >= 'A' && c <= 'Z'
+}
+
+// DetectReadFormat inspects the first few lines of a read file and
+// returns "fastq", "fasta", "tab", "sam" or "bam".  The reader is not
+// advanced.
+func DetectReadFormat(br *bufio.Reader) string {
+
+	// Peek blocks until the requested number of bytes are
+	// available, so when reading from a pipe, look at increasing
+	// amounts of data until three complete lines are found.  Peek
+	// returns an error if the file is shorter than requested, but
+	// the available bytes are still returned.
+	if buf, _ := br.Peek(len(bamMagic)); bytes.Equal(buf, bamMagic) {
+		return "bam"
+	}
+
+	var lines [][]byte
+	for n := 4096; ; n *= 2 {
+		if n > br.Size() {
+			n = br.Size()
+		}
+		buf, err := br.Peek(n)
+
+		// The last line may be incomplete.
+		lines = firstLines(buf, 4)
+		if len(lines) == 4 || err != nil || n == br.Size() {
+			if len(lines) > 3 {
+				lines = lines[0:3]
+			}
+			break
+		}
+	}
+
+	if len(lines) == 0 {
+		// An empty file, any parser will do.
+		return "fastq"
+	}
+
+	switch {
+	case samHeader(lines[0]):
+		return "sam"
+	case lines[0][0] == '@':
+		return "fastq"
+	case lines[0][0] == '>':
+		// Some fastq files use '>' to start the name line, the
+		// third line distinguishes them from fasta.
+		if len(lines) == 3 && lines[2][0] == '+' {
+			return "fastq"
+		}
+		return "fasta"
+	case bytes.Count(lines[0], []byte("\t")) >= 10:
+		// A SAM file without a header
+		return "sam"
+	case bytes.IndexByte(lines[0], '\t') != -1:
+		return "tab"
+	}
+
+	panic("unable to determine the format of the read file")
+}
+
+// fastqParser reads fastq files with four lines per read.
+type fastqParser struct {
+	scanner *bufio.Scanner
+
+	// The name of the file being read, for error messages.
+	filename string
+
+	// The number of lines consumed so far.
+	lnum int
+
+	// Lines that have been read from the scanner but not yet
+	// consumed, in file order.
+	pending []string
+
+	// True if the scanner has reached the end of the file.
+	eof bool
+}
+
+// line returns the next line of the file, and false if there are no
+// more lines.
+func (p *fastqParser) line() (string, bool) {
+
+	if len(p.pending) > 0 {
+		x := p.pending[0]
+		p.pending = p.pending[1:]
+		p.lnum++
+		return x, true
+	}
+
+	if p.eof || !p.scanner.Scan() {
+		if err := p.scanner.Err(); err != nil {
+			panic(err)
+		}
+		p.eof = true
+		return "", false
+	}
+
+	p.lnum++
+	return p.scanner.Text(), true
+}
+
+// unread returns lines to the front of the input.
+func (p *fastqParser) unread(lines ...string) {
+	p.pending = append(append([]string{}, lines...), p.pending...)
+	p.lnum -= len(lines)
+}
+
+// fastqName returns true if a line may be the name line of a fastq
+// record.  Name lines usually start with '@', but some files use '>'
+// (see DetectReadFormat).
+func fastqName(line string) bool {
+	return strings.HasPrefix(line, "@") || strings.HasPrefix(line, ">")
+}
+
+// checkFastq returns a description of the problem with a fastq record, or
+// an empty string if the record is well-formed.
+func checkFastq(lines []string) string {
+	switch {
+	case len(lines) < 4:
+		return "record is truncated"
+	case !fastqName(lines[0]):
+		return "name line does not start with '@' or '>'"
+	case !strings.HasPrefix(lines[2], "+"):
+		return "separator line does not start with '+'"
+	case len(lines[3]) != len(lines[1]):
+		return "quality and sequence lengths differ"
+	}
+	return ""
+}
+
+// resync advances to the next line that looks like the start of a
+// fastq record, returning false if there is no such line.  The first
+// line of a malformed record has already been consumed.  The discarded
+// lines are counted in ris.Skipped, with each four lines (or fewer at
+// the end) counting as one record.
+func (p *fastqParser) resync(ris *ReadInSeq) bool {
+
+	ndrop := 1
+	defer func() {
+		ris.Skipped += (ndrop + 3) / 4
+	}()
+
+	for {
+		x, ok := p.line()
+		if !ok {
+			return false
+		}
+		if x == "" {
+			continue
+		}
+		if !fastqName(x) {
+			ndrop++
+			continue
+		}
+
+		// Quality lines may also start with '@', so confirm
+		// that the separator line is in the right place.
+		y, oky := p.line()
+		z, okz := p.line()
+		if oky && okz && strings.HasPrefix(z, "+") {
+			p.unread(x, y, z)
+			return true
+		}
+		ndrop++
+		switch {
+		case okz:
+			p.unread(y, z)
+		case oky:
+			p.unread(y)
+		}
+	}
+}
+
+func (p *fastqParser) next(ris *ReadInSeq) bool {
+
+	for {
+		// Skip blank lines between records
+		first, ok := p.line()
+		if !ok {
+			return false
+		}
+		if first == "" {
+			continue
+		}
+		start := p.lnum
+
+		lines := []string{first}
+		for j := 1; j < 4; j++ {
+			x, ok := p.line()
+			if !ok {
+				break
+			}
+			lines = append(lines, x)
+		}
+
+		msg := checkFastq(lines)
+		if msg == "" {
+			ris.Name = lines[0]
+			ris.Seq = lines[1]
+			ris.Sep = lines[2]
+			ris.Qual = lines[3]
+			return true
+		}
+
+		if !ris.Lenient {
+			panic(fmt.Sprintf("%s: malformed fastq record at line %d: %s", p.filename, start, msg))
+		}
+
+		// Skip the record and look for the next one.
+		p.unread(lines[1:]...)
+		if !p.resync(ris) {
+			return false
+		}
+	}
+}
+
+// fastaParser reads fasta files, in which the sequence of a read may
+// span several lines.
+type fastaParser struct {
+	scanner *bufio.Scanner
+
+	// The name line of the next read, which has already been
+	// consumed by the scanner.
+	nextName string
+
+	seq []byte
+}
+
+func (p *fastaParser) next(ris *ReadInSeq) bool {
+
+	// Advance to the first name line.
+	for p.nextName == "" {
+		if !p.scanner.Scan() {
+			if err := p.scanner.Err(); err != nil {
+				panic(err)
+			}
+			return false
+		}
+		line := p.scanner.Text()
+		if strings.HasPrefix(line, ">") {
+			p.nextName = line
+		}
+	}
+
+	ris.Name = p.nextName
+	p.nextName = ""
+	p.seq = p.seq[0:0]
+
+	for p.scanner.Scan() {
+		line := p.scanner.Bytes()
+		if len(line) > 0 && line[0] == '>' {
+			p.nextName = string(line)
+			break
+		}
+		p.seq = append(p.seq, bytes.TrimSpace(line)...)
+	}
+
+	if err := p.scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	ris.Seq = string(p.seq)
+	return true
+}
+
+// tabParser reads files in which each line contains an identifier,
+// a tab, and a sequence.
+type tabParser struct {
+	scanner *bufio.Scanner
+}
+
+func (p *tabParser) next(ris *ReadInSeq) bool {
+
+	for p.scanner.Scan() {
+		line := p.scanner.Text()
+		if len(line) == 0 {
+			continue
+		}
+
+		toks := strings.SplitN(line, "\t", 3)
+		if len(toks) < 2 {
+			panic("tab-delimited read file line has no sequence: " + line)
+		}
+		ris.Name = toks[0]
+		ris.Seq = toks[1]
+		return true
+	}
+
+	if err := p.scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	return false
+}
@@ -0,0 +1,14 @@
+package utils
+
+// RevComp returns the reverse complement of a sequence.  IUPAC
+// ambiguity codes are complemented (e.g. R, which is A or G, becomes
+// Y, which is C or T), other letters are placed unchanged into the
+// result.
+func RevComp(seq []byte) []byte {
+	m := len(seq) - 1
+	b := make([]byte, len(seq))
+	for i, x := range seq {
+		b[m-i] = complement[x]
+	}
+	return b
+}
@@ -0,0 +1,375 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// SAM flag bits that are used when reading unaligned reads.
+const (
+	samPaired        = 0x1
+	samReverse       = 0x10
+	samFirst         = 0x40
+	samLast          = 0x80
+	samSecondary     = 0x100
+	samSupplementary = 0x800
+)
+
+// The magic bytes at the start of a (decompressed) BAM file.
+var bamMagic = []byte("BAM\x01")
+
+// The 4-bit encoding of bases in BAM records.
+const bamBases = "=ACMGRSVTWYHKDBN"
+
+// The length of the fixed-length part of a BAM record, following its
+// block size.
+const bamFixedSize = 32
+
+// readGroups parses the @RG lines of a SAM header, returning a map
+// from read group ID to sample name.  If a read group has no SM tag,
+// its ID is used as the sample name.
+func readGroups(header string) map[string]string {
+
+	rg := make(map[string]string)
+	for _, line := range strings.Split(header, "\n") {
+		if !strings.HasPrefix(line, "@RG\t") {
+			continue
+		}
+
+		var id, sm string
+		for _, f := range strings.Split(strings.TrimRight(line, "\r"), "\t")[1:] {
+			switch {
+			case strings.HasPrefix(f, "ID:"):
+				id = f[3:]
+			case strings.HasPrefix(f, "SM:"):
+				sm = f[3:]
+			}
+		}
+		if sm == "" {
+			sm = id
+		}
+		rg[id] = sm
+	}
+
+	return rg
+}
+
+// setSamRecord places a SAM/BAM record into ris.  Reads stored as
+// their reverse complement are restored to their original
+// orientation, and mates are identified with /1 and /2 suffixes on
+// their names.  It returns false if the record is a secondary or
+// supplementary alignment, which should be skipped.
+func setSamRecord(ris *ReadInSeq, name string, flag int, seq, qual []byte, rg string, groups map[string]string) bool {
+
+	if flag&(samSecondary|samSupplementary) != 0 {
+		return false
+	}
+
+	if flag&samReverse != 0 {
+		seq = RevComp(seq)
+		for i, j := 0, len(qual)-1; i < j; i, j = i+1, j-1 {
+			qual[i], qual[j] = qual[j], qual[i]
+		}
+	}
+
+	ris.Mate = 0
+	if flag&samPaired != 0 {
+		switch {
+		case flag&samFirst != 0:
+			name += "/1"
+			ris.Mate = 1
+		case flag&samLast != 0:
+			name += "/2"
+			ris.Mate = 2
+		}
+	}
+
+	ris.Name = name
+	ris.Seq = string(seq)
+	ris.Qual = string(qual)
+	ris.Sample = groups[rg]
+	if ris.Sample == "" {
+		ris.Sample = rg
+	}
+
+	return true
+}
+
+// samParser reads reads from a SAM file.
+type samParser struct {
+	scanner *bufio.Scanner
+
+	// The name of the file being read, for error messages.
+	filename string
+
+	// The number of lines read so far.
+	lnum int
+
+	// Maps read group IDs to sample names.
+	groups map[string]string
+
+	// The first record, which is read while reading the header.
+	first string
+}
+
+func newSamParser(scanner *bufio.Scanner, filename string) *samParser {
+
+	p := &samParser{scanner: scanner, filename: filename}
+
+	var header []string
+	for scanner.Scan() {
+		p.lnum++
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "@") {
+			p.first = line
+			break
+		}
+		header = append(header, line)
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+	p.groups = readGroups(strings.Join(header, "\n"))
+
+	return p
+}
+
+func (p *samParser) next(ris *ReadInSeq) bool {
+
+	for {
+		var line string
+		if p.first != "" {
+			line, p.first = p.first, ""
+		} else {
+			if !p.scanner.Scan() {
+				if err := p.scanner.Err(); err != nil {
+					panic(err)
+				}
+				return false
+			}
+			p.lnum++
+			line = p.scanner.Text()
+		}
+		if line == "" {
+			continue
+		}
+
+		f := strings.Split(line, "\t")
+		if len(f) < 11 {
+			panic(fmt.Sprintf("%s: line %d has fewer than 11 fields", p.filename, p.lnum))
+		}
+		flag, err := strconv.Atoi(f[1])
+		if err != nil {
+			panic(fmt.Sprintf("%s: line %d has an invalid flag: %s", p.filename, p.lnum, f[1]))
+		}
+
+		seq, qual := f[9], f[10]
+		if seq == "*" {
+			seq = ""
+		}
+		if qual == "*" {
+			qual = ""
+		}
+
+		var rg string
+		for _, tag := range f[11:] {
+			if strings.HasPrefix(tag, "RG:Z:") {
+				rg = tag[5:]
+			}
+		}
+
+		if setSamRecord(ris, f[0], flag, []byte(seq), []byte(qual), rg, p.groups) {
+			return true
+		}
+	}
+}
+
+// bamParser reads reads from a BAM file, which has already been
+// decompressed (BAM files are compressed with BGZF, a form of gzip).
+type bamParser struct {
+	rdr io.Reader
+
+	// The name of the file being read, for error messages.
+	filename string
+
+	// Maps read group IDs to sample names.
+	groups map[string]string
+
+	// Workspace for one record.
+	buf []byte
+
+	// The number of records read, for error messages.
+	nrec int
+}
+
+// readInt32 reads a little-endian 32 bit integer.
+func readInt32(rdr io.Reader) (int32, error) {
+	var x int32
+	err := binary.Read(rdr, binary.LittleEndian, &x)
+	return x, err
+}
+
+func newBamParser(rdr io.Reader, filename string) *bamParser {
+
+	p := &bamParser{rdr: rdr, filename: filename}
+
+	fail := func(err error) {
+		panic(fmt.Sprintf("%s: unable to read BAM header: %v", filename, err))
+	}
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(rdr, magic); err != nil {
+		fail(err)
+	}
+	if !bytes.Equal(magic, bamMagic) {
+		panic(fmt.Sprintf("%s is not a BAM file", filename))
+	}
+
+	// The header text
+	n, err := readInt32(rdr)
+	if err != nil {
+		fail(err)
+	}
+	text := make([]byte, n)
+	if _, err := io.ReadFull(rdr, text); err != nil {
+		fail(err)
+	}
+	p.groups = readGroups(string(bytes.TrimRight(text, "\x00")))
+
+	// The reference sequences are not needed.
+	nref, err := readInt32(rdr)
+	if err != nil {
+		fail(err)
+	}
+	for i := int32(0); i < nref; i++ {
+		n, err := readInt32(rdr)
+		if err != nil {
+			fail(err)
+		}
+		if _, err := io.CopyN(ioutil.Discard, rdr, int64(n)+4); err != nil {
+			fail(err)
+		}
+	}
+
+	return p
+}
+
+// auxSize returns the number of bytes occupied by an auxiliary field
+// value of the given type, starting at the beginning of b.
+func auxSize(typ byte, b []byte) int {
+	switch typ {
+	case 'A', 'c', 'C':
+		return 1
+	case 's', 'S':
+		return 2
+	case 'i', 'I', 'f':
+		return 4
+	case 'Z', 'H':
+		return bytes.IndexByte(b, 0) + 1
+	case 'B':
+		if len(b) < 5 {
+			return -1
+		}
+		n := int(binary.LittleEndian.Uint32(b[1:5]))
+		m := auxSize(b[0], nil)
+		if m <= 0 {
+			return -1
+		}
+		return 5 + n*m
+	}
+	return -1
+}
+
+// readGroup returns the RG tag from the auxiliary fields of a BAM
+// record, or an empty string if there is no RG tag.
+func readGroup(aux []byte) string {
+
+	for len(aux) >= 3 {
+		tag, typ := string(aux[0:2]), aux[2]
+		aux = aux[3:]
+		n := auxSize(typ, aux)
+		if n <= 0 || n > len(aux) {
+			break
+		}
+		if tag == "RG" && typ == 'Z' {
+			return string(aux[0 : n-1])
+		}
+		aux = aux[n:]
+	}
+
+	return ""
+}
+
+func (p *bamParser) next(ris *ReadInSeq) bool {
+
+	for {
+		size, err := readInt32(p.rdr)
+		if err == io.EOF {
+			return false
+		} else if err != nil {
+			panic(fmt.Sprintf("%s: %v", p.filename, err))
+		}
+
+		p.nrec++
+
+		// The block must hold at least the fixed-length part of
+		// the record, which is checked before allocating it.
+		if size < bamFixedSize {
+			panic(fmt.Sprintf("%s: malformed BAM record %d: block size %d is less than %d",
+				p.filename, p.nrec, size, bamFixedSize))
+		}
+
+		if cap(p.buf) < int(size) {
+			p.buf = make([]byte, size)
+		}
+		b := p.buf[0:size]
+		if _, err := io.ReadFull(p.rdr, b); err != nil {
+			panic(fmt.Sprintf("%s: truncated BAM record: %v", p.filename, err))
+		}
+
+		// The fixed-length part of the record
+		lname := int(b[8])
+		ncigar := int(binary.LittleEndian.Uint16(b[12:14]))
+		flag := int(binary.LittleEndian.Uint16(b[14:16]))
+		lseq := int(binary.LittleEndian.Uint32(b[16:20]))
+		b = b[bamFixedSize:]
+
+		if need := lname + 4*ncigar + (lseq+1)/2 + lseq; need > len(b) {
+			panic(fmt.Sprintf("%s: malformed BAM record %d: fields need %d bytes but the block has %d",
+				p.filename, p.nrec, need, len(b)))
+		}
+
+		name := string(bytes.TrimRight(b[0:lname], "\x00"))
+		b = b[lname+4*ncigar:]
+
+		seq := make([]byte, lseq)
+		for i := range seq {
+			x := b[i/2]
+			if i%2 == 0 {
+				x >>= 4
+			}
+			seq[i] = bamBases[x&0xf]
+		}
+		b = b[(lseq+1)/2:]
+
+		// Missing qualities are stored as 0xff
+		var qual []byte
+		if lseq > 0 && b[0] != 0xff {
+			qual = make([]byte, lseq)
+			for i := range qual {
+				qual[i] = b[i] + 33
+			}
+		}
+		b = b[lseq:]
+
+		if setSamRecord(ris, name, flag, seq, qual, readGroup(b), p.groups) {
+			return true
+		}
+	}
+}
@@ -1,11 +1,15 @@
 // This script takes raw read file (after sorting and
 // removing/counting duplicates) and generates a new file in which
-// each row has three fields separated by tab characters.  The first
+// each row has four fields separated by tab characters.  The first
 // field is a subsequence of the original full sequence, beginning and
 // ending at positions provided by command-line arguments.  The second
-// field is the full original sequence, the third field is the count
-// of the full read.  If the full read ends before the end of the
-// selected window, it is skipped.
+// and third fields are the parts of the sequence to the left and
+// right of the window.  The fourth field is the strand, '+' if the
+// windows were taken from the read as given, or '-' if they were
+// taken from its reverse complement (see SearchStrand).  If the full
+// read ends before the end of the selected window, it is skipped.
+// Windows that fail the complexity filters (see MinDinuc, MaxDust,
+// MinEntropy and MaxHomopolymer) are also skipped.
 
 package main
 
@@ -84,7 +88,9 @@ func main() {
 		wtrs = append(wtrs, wtr)
 	}
 
-	wk := make([]int, 25)
+	cfilter := utils.NewComplexityFilter(config)
+
+	strands := config.Strands()
 
 	nread := make([]int, len(config.Windows))
 	for jj := 0; scanner.Scan(); jj++ {
@@ -96,46 +102,61 @@ func main() {
 		line := scanner.Bytes() // don't need copy
 		seq := bytes.Fields(line)[0]
 
-		var bbuf bytes.Buffer
 		for k := 0; k < len(config.Windows); k++ {
+			if len(seq) >= config.Windows[k]+config.WindowWidth {
+				nread[k]++
+			}
+		}
 
-			q1 := config.Windows[k]
-			q2 := q1 + config.WindowWidth
+		var bbuf bytes.Buffer
+		for _, strand := range strands {
 
-			// Sequence is too short
-			if len(seq) < q2 {
-				continue
+			sseq := seq
+			if strand == '-' {
+				sseq = utils.RevComp(seq)
 			}
-			nread[k]++
 
-			key := seq[q1:q2]
-			if utils.CountDinuc(key, wk) < config.MinDinuc {
-				continue
-			}
+			for k := 0; k < len(config.Windows); k++ {
+
+				q1 := config.Windows[k]
+				q2 := q1 + config.WindowWidth
 
-			bbuf.Reset()
-			_, err1 := bbuf.Write(key)
-			_, err2 := bbuf.WriteString("\t")
-			_, err3 := bbuf.Write(seq[0:q1])
-			_, err4 := bbuf.WriteString("\t")
-			_, err5 := bbuf.Write(seq[q2:len(seq)])
-			_, err6 := bbuf.Write([]byte("\n"))
-
-			for _, e := range []error{err1, err2, err3, err4, err5, err6} {
-				if e != nil {
-					logger.Print(e)
-					panic(e)
+				// Sequence is too short
+				if len(sseq) < q2 {
+					continue
+				}
+
+				key := sseq[q1:q2]
+				if !cfilter.Check(key) {
+					continue
 				}
-			}
 
-			_, err := wtrs[k].Write(bbuf.Bytes())
-			if err != nil {
-				logger.Print(err)
-				panic(err)
+				bbuf.Reset()
+				_, err1 := bbuf.Write(key)
+				_, err2 := bbuf.WriteString("\t")
+				_, err3 := bbuf.Write(sseq[0:q1])
+				_, err4 := bbuf.WriteString("\t")
+				_, err5 := bbuf.Write(sseq[q2:len(sseq)])
+				_, err6 := bbuf.Write([]byte{'\t', strand, '\n'})
+
+				for _, e := range []error{err1, err2, err3, err4, err5, err6} {
+					if e != nil {
+						logger.Print(e)
+						panic(e)
+					}
+				}
+
+				_, err := wtrs[k].Write(bbuf.Bytes())
+				if err != nil {
+					logger.Print(err)
+					panic(err)
+				}
 			}
 		}
 	}
 
+	cfilter.LogDropped(logger)
+
 	for k, n := range nread {
 		logger.Printf("Window %d produced %d valid reads", k, n)
 